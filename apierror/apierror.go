@@ -0,0 +1,262 @@
+// Package apierror defines the errors the proxy answers with.
+//
+// Every error is rendered as
+//
+//	{
+//	  "error": {
+//	    "code": "upstream_timeout",   // stable machine readable code
+//	    "type": "upstream_error",     // coarse category
+//	    "message": "...",             // human readable description
+//	    "status": 504,                // HTTP status of the response
+//	    "upstream": {...}             // upstream JSON body, when relayed
+//	  }
+//	}
+//
+// The shape is a superset of the OpenAI API error, so OpenAI SDK clients can
+// read it too.
+package apierror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+type Code string
+
+const (
+	CodeInvalidRequest Code = "invalid_request"
+	CodeInvalidConfig  Code = "invalid_config"
+	CodeInvalidAPIKey  Code = "invalid_api_key"
+	CodeNotFound       Code = "not_found"
+	CodeTokenNotFound  Code = "access_token_not_found"
+	CodeTokenExpired   Code = "access_token_expired"
+	CodeInternal       Code = "internal_error"
+	CodeArkoseToken    Code = "arkose_token_failed"
+	CodeRateLimited    Code = "rate_limited"
+	CodeTooManyStreams Code = "too_many_streams"
+	CodeQueueFull      Code = "queue_full"
+	CodeQueueTimeout   Code = "queue_timeout"
+	CodeQuotaExceeded  Code = "quota_exceeded"
+
+	CodeUpstreamUnreachable Code = "upstream_unreachable"
+	CodeUpstreamTimeout     Code = "upstream_timeout"
+	CodeUpstreamStream      Code = "upstream_stream_error"
+
+	CodeUpstreamBadRequest   Code = "upstream_bad_request"
+	CodeUpstreamUnauthorized Code = "upstream_unauthorized"
+	CodeUpstreamForbidden    Code = "upstream_forbidden"
+	CodeUpstreamNotFound     Code = "upstream_not_found"
+	CodeUpstreamRateLimited  Code = "upstream_rate_limited"
+	CodeUpstreamUnavailable  Code = "upstream_unavailable"
+)
+
+// maxMessageLength caps plain text upstream bodies used as messages.
+const maxMessageLength = 512
+
+// Error is an error with the status and code it is answered with.
+type Error struct {
+	Code    Code
+	Status  int
+	Message string
+	// Upstream is the JSON body returned by the upstream, if any.
+	Upstream json.RawMessage
+	// Err is the underlying cause.
+	Err error
+	// RetryAfter, if set, is sent in the Retry-After header.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Response is the JSON document an error is rendered as.
+type Response struct {
+	Error Body `json:"error"`
+}
+
+type Body struct {
+	Code     Code            `json:"code"`
+	Type     string          `json:"type"`
+	Message  string          `json:"message"`
+	Status   int             `json:"status"`
+	Upstream json.RawMessage `json:"upstream,omitempty"`
+}
+
+func (e *Error) Response() Response {
+	return Response{Error: Body{
+		Code:     e.Code,
+		Type:     e.Type(),
+		Message:  e.Message,
+		Status:   e.Status,
+		Upstream: e.Upstream,
+	}}
+}
+
+// Type returns the category of the error code.
+func (e *Error) Type() string {
+	switch {
+	case e.Code == CodeInvalidRequest, e.Code == CodeInvalidConfig:
+		return "invalid_request_error"
+	case e.Code == CodeInvalidAPIKey, e.Code == CodeTokenNotFound, e.Code == CodeTokenExpired:
+		return "authentication_error"
+	case e.Code == CodeNotFound:
+		return "invalid_request_error"
+	case e.Code == CodeRateLimited, e.Code == CodeTooManyStreams, e.Code == CodeQueueFull, e.Code == CodeQueueTimeout, e.Code == CodeQuotaExceeded:
+		return "rate_limit_error"
+	case e.Code == CodeArkoseToken:
+		return "arkose_error"
+	case strings.HasPrefix(string(e.Code), "upstream_"):
+		return "upstream_error"
+	default:
+		return "server_error"
+	}
+}
+
+func New(code Code, status int, message string) *Error {
+	return &Error{Code: code, Status: status, Message: message}
+}
+
+// BadRequest wraps an error caused by the caller's request, such as
+// malformed JSON.
+func BadRequest(err error) *Error {
+	return &Error{Code: CodeInvalidRequest, Status: 400, Message: err.Error(), Err: err}
+}
+
+// Arkose wraps a failure to obtain an arkose token.
+func Arkose(err error) *Error {
+	return &Error{Code: CodeArkoseToken, Status: 502, Message: "failed to get arkose token", Err: err}
+}
+
+// RateLimited reports a caller over its rate limit, who may retry after
+// retryAfter.
+func RateLimited(message string, retryAfter time.Duration) *Error {
+	return &Error{Code: CodeRateLimited, Status: 429, Message: message, RetryAfter: retryAfter}
+}
+
+// TooManyStreams reports that the concurrent stream cap is reached.
+func TooManyStreams() *Error {
+	return &Error{Code: CodeTooManyStreams, Status: 429, Message: "too many concurrent conversations", RetryAfter: time.Second}
+}
+
+// QueueFull reports that too many conversations already wait for the same
+// access token.
+func QueueFull() *Error {
+	return &Error{Code: CodeQueueFull, Status: 429, Message: "too many conversations queued for this access token", RetryAfter: time.Second}
+}
+
+// QueueTimeout reports a conversation that waited its turn for too long.
+func QueueTimeout(waited time.Duration) *Error {
+	return &Error{Code: CodeQueueTimeout, Status: 503, Message: fmt.Sprintf("conversation waited in queue for %s", waited), RetryAfter: time.Second}
+}
+
+// QuotaExceeded rejects a caller whose usage quota is exhausted until the
+// quota period ends.
+func QuotaExceeded(message string, retryAfter time.Duration) *Error {
+	return &Error{Code: CodeQuotaExceeded, Status: 429, Message: message, RetryAfter: retryAfter}
+}
+
+// Internal wraps an unexpected error.
+func Internal(err error) *Error {
+	return &Error{Code: CodeInternal, Status: 500, Message: err.Error(), Err: err}
+}
+
+// Transport wraps an error of the request to the upstream: timeouts are
+// answered with 504, anything else with 502.
+func Transport(err error) *Error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &Error{Code: CodeUpstreamTimeout, Status: 504, Message: "upstream request timed out", Err: err}
+	}
+	return &Error{Code: CodeUpstreamUnreachable, Status: 502, Message: "upstream request failed", Err: err}
+}
+
+// Stream wraps an error reported by or while reading an upstream stream.
+func Stream(message string) *Error {
+	return &Error{Code: CodeUpstreamStream, Status: 502, Message: message}
+}
+
+// Upstream builds the error of a failed upstream response from its status,
+// content type and body.
+func Upstream(status int, statusText string, contentType string, body []byte) *Error {
+	e := &Error{
+		Code:    upstreamCode(status),
+		Status:  status,
+		Message: fmt.Sprintf("upstream returned %d %s", status, statusText),
+	}
+
+	if json.Valid(body) {
+		e.Upstream = body
+		if message := upstreamMessage(body); message != "" {
+			e.Message = message
+		}
+	} else if text := strings.TrimSpace(string(body)); text != "" && len(text) <= maxMessageLength &&
+		strings.HasPrefix(contentType, "text/plain") {
+		e.Message = text
+	}
+	return e
+}
+
+// From returns err as an *Error, wrapping unknown errors as internal ones.
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return Internal(err)
+}
+
+// upstreamMessage finds the human readable message of an upstream JSON
+// error, which is either {"detail": "..."}, {"detail": {"message": "..."}}
+// or {"error": {"message": "..."}}.
+func upstreamMessage(body []byte) string {
+	var payload struct {
+		Detail json.RawMessage `json:"detail"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	for _, raw := range []json.RawMessage{payload.Detail, payload.Error} {
+		var text string
+		if err := json.Unmarshal(raw, &text); err == nil && text != "" {
+			return text
+		}
+		var object struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(raw, &object); err == nil && object.Message != "" {
+			return object.Message
+		}
+	}
+	return ""
+}
+
+func upstreamCode(status int) Code {
+	switch {
+	case status == 401:
+		return CodeUpstreamUnauthorized
+	case status == 403:
+		return CodeUpstreamForbidden
+	case status == 404:
+		return CodeUpstreamNotFound
+	case status == 429:
+		return CodeUpstreamRateLimited
+	case status >= 500:
+		return CodeUpstreamUnavailable
+	default:
+		return CodeUpstreamBadRequest
+	}
+}
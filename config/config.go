@@ -0,0 +1,838 @@
+// Package config loads the proxy settings.
+//
+// Values are resolved in the following order, later sources overriding
+// earlier ones:
+//
+//  1. built-in defaults
+//  2. the config file (-config flag or CONFIG_FILE env), YAML or TOML by extension
+//  3. environment variables
+//  4. command line flags
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	tlsclient "github.com/bogdanfinn/tls-client"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	redacted = "[REDACTED]"
+
+	defaultScheme        = "https"
+	defaultHost          = "chat.openai.com"
+	defaultBackendPrefix = "/backend-api"
+	defaultPublicPrefix  = "/public-api"
+	defaultUserAgent     = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/112.0.0.0 Safari/537.36"
+)
+
+// AnonymousUser is the name usage without a proxy key is accounted under.
+// No api key may take it.
+const AnonymousUser = "anonymous"
+
+type Config struct {
+	Server   Server   `yaml:"server" toml:"server"`
+	Upstream Upstream `yaml:"upstream" toml:"upstream"`
+	Client   Client   `yaml:"client" toml:"client"`
+	Headers  Headers  `yaml:"headers" toml:"headers"`
+	Auth     Auth     `yaml:"auth" toml:"auth"`
+	Vault    Vault    `yaml:"vault" toml:"vault"`
+	Limits   Limits   `yaml:"limits" toml:"limits"`
+	Queue    Queue    `yaml:"queue" toml:"queue"`
+	Usage    Usage    `yaml:"usage" toml:"usage"`
+	Metrics  Metrics  `yaml:"metrics" toml:"metrics"`
+	Log      Log      `yaml:"log" toml:"log"`
+	Tracing  Tracing  `yaml:"tracing" toml:"tracing"`
+	Health   Health   `yaml:"health" toml:"health"`
+	Watch    Watch    `yaml:"watch" toml:"watch"`
+
+	// args and file are the command line and config file the config was
+	// loaded from.
+	args []string
+	file string
+}
+
+// Server holds the listen address of the proxy.
+type Server struct {
+	Host string `yaml:"host" toml:"host"`
+	Port int    `yaml:"port" toml:"port"`
+	// ShutdownTimeout is how long active streams may run on after a
+	// shutdown signal before they are cancelled.
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// TrustedProxies are the addresses or CIDR ranges of the reverse
+	// proxies whose X-Forwarded-For header gives the client IP. By default
+	// no proxy is trusted and the client IP is the peer address.
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+}
+
+// Upstream describes where proxied requests are sent to.
+type Upstream struct {
+	Scheme        string `yaml:"scheme" toml:"scheme"`
+	Host          string `yaml:"host" toml:"host"`
+	BackendPrefix string `yaml:"backend_prefix" toml:"backend_prefix"`
+	PublicPrefix  string `yaml:"public_prefix" toml:"public_prefix"`
+}
+
+// Client configures the outbound tls-client.
+type Client struct {
+	Proxy           string   `yaml:"proxy" toml:"proxy"`
+	Timeout         Duration `yaml:"timeout" toml:"timeout"`
+	Profile         string   `yaml:"profile" toml:"profile"`
+	UserAgent       string   `yaml:"user_agent" toml:"user_agent"`
+	RecycleInterval Duration `yaml:"recycle_interval" toml:"recycle_interval"`
+}
+
+// Headers controls which headers cross the proxy.
+type Headers struct {
+	// Response lists the upstream response headers relayed to the caller
+	// besides Content-Type. A trailing "*" matches any suffix.
+	Response []string `yaml:"response" toml:"response"`
+	// Request lists the policies applied to caller headers. The first policy
+	// whose route matches the upstream path is used.
+	Request []HeaderPolicy `yaml:"request" toml:"request"`
+}
+
+// HeaderPolicy decides which caller headers are forwarded upstream on a
+// route. Header names and routes accept a trailing "*" matching any suffix.
+type HeaderPolicy struct {
+	// Route is the path below the upstream prefix, e.g. "/conversation" or
+	// "/files/*". "*" matches every route.
+	Route string `yaml:"route" toml:"route"`
+	// Allow lists the caller headers that are forwarded.
+	Allow []string `yaml:"allow" toml:"allow"`
+	// Deny lists caller headers that are never forwarded, even if allowed.
+	Deny []string `yaml:"deny" toml:"deny"`
+	// Set holds static headers added to every upstream request, overriding
+	// forwarded ones.
+	Set map[string]string `yaml:"set" toml:"set"`
+}
+
+// Auth configures the proxy's own API keys. When no key is configured the
+// proxy forwards the caller's access token as is.
+type Auth struct {
+	Keys []APIKey `yaml:"keys" toml:"keys"`
+	// KeysFile names a YAML or TOML file with more keys, in the same
+	// "keys" format.
+	KeysFile string `yaml:"keys_file" toml:"keys_file"`
+	// AdminKeys grant access to the /admin API, which is disabled without
+	// them.
+	AdminKeys []string `yaml:"admin_keys" toml:"admin_keys"`
+	// ExpiryWarning is how long before expiry access tokens are warned
+	// about in the log.
+	ExpiryWarning Duration `yaml:"expiry_warning" toml:"expiry_warning"`
+}
+
+// APIKey maps a proxy key onto the upstream access token used for it, given
+// either inline or as the name of a token stored in the vault.
+type APIKey struct {
+	Name        string `yaml:"name" toml:"name"`
+	Key         string `yaml:"key" toml:"key"`
+	AccessToken string `yaml:"access_token" toml:"access_token"`
+	Token       string `yaml:"token" toml:"token"`
+}
+
+// Vault configures the encrypted store of upstream access tokens. The key
+// is a base64 encoded 32 byte AES key, preferably given through VAULT_KEY
+// or a key file rather than the config file.
+type Vault struct {
+	Path    string `yaml:"path" toml:"path"`
+	Key     string `yaml:"key" toml:"key"`
+	KeyFile string `yaml:"key_file" toml:"key_file"`
+}
+
+// Limits throttles callers. Zero values disable a limit.
+type Limits struct {
+	PerKey RateLimit `yaml:"per_key" toml:"per_key"`
+	PerIP  RateLimit `yaml:"per_ip" toml:"per_ip"`
+	// MaxStreams caps the conversation streams in flight.
+	MaxStreams int `yaml:"max_streams" toml:"max_streams"`
+	// MaxStreamsPerKey caps the conversation streams in flight per proxy
+	// key.
+	MaxStreamsPerKey int `yaml:"max_streams_per_key" toml:"max_streams_per_key"`
+}
+
+// Queue serializes conversations sent with the same access token, which the
+// upstream allows only one at a time.
+type Queue struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// MaxLength is the number of conversations that may wait per token.
+	MaxLength int `yaml:"max_length" toml:"max_length"`
+	// WaitTimeout is how long a conversation may wait for its turn.
+	WaitTimeout Duration `yaml:"wait_timeout" toml:"wait_timeout"`
+}
+
+// Usage configures the accounting of conversations per proxy key.
+type Usage struct {
+	// Path is the JSON file usage is persisted to. Without it usage is kept
+	// in memory only.
+	Path          string   `yaml:"path" toml:"path"`
+	FlushInterval Duration `yaml:"flush_interval" toml:"flush_interval"`
+	Quotas        Quotas   `yaml:"quotas" toml:"quotas"`
+}
+
+// Quotas limit the usage of each proxy key. Keys maps key names onto their
+// own quota, replacing the default one.
+type Quotas struct {
+	Default Quota            `yaml:"default" toml:"default"`
+	Keys    map[string]Quota `yaml:"keys" toml:"keys"`
+}
+
+// Quota caps the requests and estimated tokens per UTC day and month. Zero
+// values are unlimited.
+type Quota struct {
+	DailyRequests   int64 `yaml:"daily_requests" toml:"daily_requests"`
+	DailyTokens     int64 `yaml:"daily_tokens" toml:"daily_tokens"`
+	MonthlyRequests int64 `yaml:"monthly_requests" toml:"monthly_requests"`
+	MonthlyTokens   int64 `yaml:"monthly_tokens" toml:"monthly_tokens"`
+}
+
+// Metrics configures the Prometheus endpoint served at /metrics.
+type Metrics struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+}
+
+// Log configures the structured log. Redact replaces authorization headers,
+// tokens, account e-mail addresses and message content with a placeholder.
+type Log struct {
+	// Level is one of debug, info, warn and error.
+	Level string `yaml:"level" toml:"level"`
+	// Format is json or text.
+	Format string `yaml:"format" toml:"format"`
+	Redact bool   `yaml:"redact" toml:"redact"`
+}
+
+// Tracing configures the export of OpenTelemetry spans over OTLP/HTTP.
+// Tracing is disabled without an endpoint.
+type Tracing struct {
+	// Endpoint is the collector URL, e.g. http://localhost:4318. The path
+	// defaults to /v1/traces.
+	Endpoint    string            `yaml:"endpoint" toml:"endpoint"`
+	Headers     map[string]string `yaml:"headers" toml:"headers"`
+	ServiceName string            `yaml:"service_name" toml:"service_name"`
+	// SampleRatio is the share of traces started by the proxy that are
+	// recorded. Traces started by the caller follow the caller's decision.
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+}
+
+// Health configures the checks of the /readyz endpoint.
+type Health struct {
+	// ProxyTimeout bounds the connection attempt to the outbound proxy.
+	ProxyTimeout Duration `yaml:"proxy_timeout" toml:"proxy_timeout"`
+	// ErrorWindow is the period over which the upstream error rate is
+	// computed.
+	ErrorWindow Duration `yaml:"error_window" toml:"error_window"`
+	// MaxErrorRate is the share of failed upstream requests above which the
+	// proxy is not ready.
+	MaxErrorRate float64 `yaml:"max_error_rate" toml:"max_error_rate"`
+	// MinRequests is the number of upstream requests in the window below
+	// which the error rate is not judged.
+	MinRequests int `yaml:"min_requests" toml:"min_requests"`
+}
+
+// Watch configures the watch of the config and keys files, which reloads
+// the config when they change.
+type Watch struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// Interval is how often the files are checked for changes.
+	Interval Duration `yaml:"interval" toml:"interval"`
+}
+
+// RateLimit is a token bucket refilled at RequestsPerMinute and holding up
+// to Burst requests, which defaults to RequestsPerMinute.
+type RateLimit struct {
+	RequestsPerMinute float64 `yaml:"requests_per_minute" toml:"requests_per_minute"`
+	Burst             int     `yaml:"burst" toml:"burst"`
+}
+
+// Duration is a time.Duration written as "30s", "10m" etc. in config files.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Port:            8080,
+			ShutdownTimeout: Duration(30 * time.Second),
+		},
+		Upstream: Upstream{
+			Scheme:        defaultScheme,
+			Host:          defaultHost,
+			BackendPrefix: defaultBackendPrefix,
+			PublicPrefix:  defaultPublicPrefix,
+		},
+		Client: Client{
+			Timeout:         Duration(360 * time.Second),
+			Profile:         "firefox_110",
+			UserAgent:       defaultUserAgent,
+			RecycleInterval: Duration(10 * time.Minute),
+		},
+		Auth: Auth{
+			ExpiryWarning: Duration(72 * time.Hour),
+		},
+		Queue: Queue{
+			MaxLength:   10,
+			WaitTimeout: Duration(2 * time.Minute),
+		},
+		Usage: Usage{
+			FlushInterval: Duration(time.Minute),
+		},
+		Metrics: Metrics{
+			Enabled: true,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "json",
+			Redact: true,
+		},
+		Tracing: Tracing{
+			ServiceName: "chatgpt-proxy",
+			SampleRatio: 1,
+		},
+		Watch: Watch{
+			Enabled:  true,
+			Interval: Duration(5 * time.Second),
+		},
+		Health: Health{
+			ProxyTimeout: Duration(3 * time.Second),
+			ErrorWindow:  Duration(5 * time.Minute),
+			MaxErrorRate: 0.5,
+			MinRequests:  10,
+		},
+		Headers: Headers{
+			Response: []string{
+				"Cache-Control",
+				"Content-Disposition",
+				"Retry-After",
+				"X-Ratelimit-*",
+			},
+			Request: []HeaderPolicy{
+				{
+					Route: "*",
+					Allow: []string{"Accept", "Accept-Language", "Content-Type"},
+				},
+			},
+		},
+	}
+}
+
+// Load builds the configuration from defaults, the config file, the
+// environment and the given command line arguments, then validates it.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("chatgpt-proxy", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	host := fs.String("host", "", "listen host")
+	port := fs.Int("port", 0, "listen port")
+	proxy := fs.String("proxy", "", "outbound HTTP proxy")
+	upstreamScheme := fs.String("upstream-scheme", "", "upstream scheme (http or https)")
+	upstreamHost := fs.String("upstream-host", "", "upstream host")
+	timeout := fs.Duration("timeout", 0, "upstream request timeout")
+	profile := fs.String("profile", "", "tls-client profile")
+	userAgent := fs.String("user-agent", "", "user agent sent upstream")
+	keysFile := fs.String("keys-file", "", "file with proxy API keys")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			cfg.Server.Host = *host
+		case "port":
+			cfg.Server.Port = *port
+		case "proxy":
+			cfg.Client.Proxy = *proxy
+		case "upstream-scheme":
+			cfg.Upstream.Scheme = *upstreamScheme
+		case "upstream-host":
+			cfg.Upstream.Host = *upstreamHost
+		case "timeout":
+			cfg.Client.Timeout = Duration(*timeout)
+		case "profile":
+			cfg.Client.Profile = *profile
+		case "user-agent":
+			cfg.Client.UserAgent = *userAgent
+		case "keys-file":
+			cfg.Auth.KeysFile = *keysFile
+		}
+	})
+
+	if cfg.Auth.KeysFile != "" {
+		var keys struct {
+			Keys []APIKey `yaml:"keys" toml:"keys"`
+		}
+		if err := decodeFile(cfg.Auth.KeysFile, &keys); err != nil {
+			return nil, err
+		}
+		cfg.Auth.Keys = append(cfg.Auth.Keys, keys.Keys...)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.args = args
+	cfg.file = *path
+	return cfg, nil
+}
+
+// Reload loads the config again from the sources c was loaded from.
+func (c *Config) Reload() (*Config, error) {
+	return Load(c.args)
+}
+
+// File returns the config file c was loaded from, if any.
+func (c *Config) File() string {
+	return c.file
+}
+
+// Redacted returns a copy of c with keys, tokens, header values and proxy
+// credentials replaced with a placeholder.
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.Client.Proxy != "" {
+		if u, err := url.Parse(r.Client.Proxy); err == nil {
+			r.Client.Proxy = u.Redacted()
+		}
+	}
+	r.Headers.Request = make([]HeaderPolicy, len(c.Headers.Request))
+	for i, p := range c.Headers.Request {
+		p.Set = redactValues(p.Set)
+		r.Headers.Request[i] = p
+	}
+	r.Auth.Keys = make([]APIKey, len(c.Auth.Keys))
+	for i, k := range c.Auth.Keys {
+		k.Key = redacted
+		if k.AccessToken != "" {
+			k.AccessToken = redacted
+		}
+		r.Auth.Keys[i] = k
+	}
+	r.Auth.AdminKeys = make([]string, len(c.Auth.AdminKeys))
+	for i := range c.Auth.AdminKeys {
+		r.Auth.AdminKeys[i] = redacted
+	}
+	if r.Vault.Key != "" {
+		r.Vault.Key = redacted
+	}
+	r.Tracing.Headers = redactValues(c.Tracing.Headers)
+	return &r
+}
+
+func redactValues(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	r := make(map[string]string, len(m))
+	for k := range m {
+		r[k] = redacted
+	}
+	return r
+}
+
+func (c *Config) loadFile(path string) error {
+	return decodeFile(path, c)
+}
+
+// decodeFile decodes a YAML or TOML file, chosen by extension, into v.
+func decodeFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, v)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, v)
+	default:
+		return fmt.Errorf("unsupported config file type: %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	setFromEnv(&c.Server.Host, "HOST")
+	if err := setIntFromEnv(&c.Server.Port, "PORT"); err != nil {
+		return err
+	}
+	if err := setDurationFromEnv(&c.Server.ShutdownTimeout, "SHUTDOWN_TIMEOUT"); err != nil {
+		return err
+	}
+	setListFromEnv(&c.Server.TrustedProxies, "TRUSTED_PROXIES")
+
+	setFromEnv(&c.Upstream.Scheme, "UPSTREAM_SCHEME")
+	setFromEnv(&c.Upstream.Host, "UPSTREAM_HOST")
+	setFromEnv(&c.Upstream.BackendPrefix, "UPSTREAM_BACKEND_PREFIX")
+	setFromEnv(&c.Upstream.PublicPrefix, "UPSTREAM_PUBLIC_PREFIX")
+
+	setFromEnv(&c.Client.Proxy, "HTTP_PROXY")
+	setFromEnv(&c.Client.Profile, "CLIENT_PROFILE")
+	setFromEnv(&c.Client.UserAgent, "USER_AGENT")
+	if err := setDurationFromEnv(&c.Client.Timeout, "CLIENT_TIMEOUT"); err != nil {
+		return err
+	}
+	if err := setDurationFromEnv(&c.Client.RecycleInterval, "CLIENT_RECYCLE_INTERVAL"); err != nil {
+		return err
+	}
+
+	setListFromEnv(&c.Headers.Response, "RESPONSE_HEADERS")
+
+	setFromEnv(&c.Auth.KeysFile, "AUTH_KEYS_FILE")
+	setListFromEnv(&c.Auth.AdminKeys, "ADMIN_KEYS")
+	if err := setDurationFromEnv(&c.Auth.ExpiryWarning, "TOKEN_EXPIRY_WARNING"); err != nil {
+		return err
+	}
+
+	if err := setFloatFromEnv(&c.Limits.PerKey.RequestsPerMinute, "LIMIT_KEY_RPM"); err != nil {
+		return err
+	}
+	if err := setFloatFromEnv(&c.Limits.PerIP.RequestsPerMinute, "LIMIT_IP_RPM"); err != nil {
+		return err
+	}
+	if err := setIntFromEnv(&c.Limits.MaxStreams, "LIMIT_MAX_STREAMS"); err != nil {
+		return err
+	}
+	if err := setIntFromEnv(&c.Limits.MaxStreamsPerKey, "LIMIT_MAX_STREAMS_PER_KEY"); err != nil {
+		return err
+	}
+
+	if err := setBoolFromEnv(&c.Queue.Enabled, "QUEUE_ENABLED"); err != nil {
+		return err
+	}
+	if err := setIntFromEnv(&c.Queue.MaxLength, "QUEUE_MAX_LENGTH"); err != nil {
+		return err
+	}
+	if err := setDurationFromEnv(&c.Queue.WaitTimeout, "QUEUE_WAIT_TIMEOUT"); err != nil {
+		return err
+	}
+
+	setFromEnv(&c.Usage.Path, "USAGE_PATH")
+	if err := setDurationFromEnv(&c.Usage.FlushInterval, "USAGE_FLUSH_INTERVAL"); err != nil {
+		return err
+	}
+
+	if err := setBoolFromEnv(&c.Metrics.Enabled, "METRICS_ENABLED"); err != nil {
+		return err
+	}
+
+	setFromEnv(&c.Log.Level, "LOG_LEVEL")
+	setFromEnv(&c.Log.Format, "LOG_FORMAT")
+	if err := setBoolFromEnv(&c.Log.Redact, "LOG_REDACT"); err != nil {
+		return err
+	}
+
+	setFromEnv(&c.Tracing.Endpoint, "TRACING_ENDPOINT")
+	setFromEnv(&c.Tracing.ServiceName, "TRACING_SERVICE_NAME")
+	if err := setFloatFromEnv(&c.Tracing.SampleRatio, "TRACING_SAMPLE_RATIO"); err != nil {
+		return err
+	}
+
+	if err := setDurationFromEnv(&c.Health.ErrorWindow, "HEALTH_ERROR_WINDOW"); err != nil {
+		return err
+	}
+	if err := setFloatFromEnv(&c.Health.MaxErrorRate, "HEALTH_MAX_ERROR_RATE"); err != nil {
+		return err
+	}
+	if err := setIntFromEnv(&c.Health.MinRequests, "HEALTH_MIN_REQUESTS"); err != nil {
+		return err
+	}
+
+	if err := setBoolFromEnv(&c.Watch.Enabled, "CONFIG_WATCH"); err != nil {
+		return err
+	}
+	if err := setDurationFromEnv(&c.Watch.Interval, "CONFIG_WATCH_INTERVAL"); err != nil {
+		return err
+	}
+
+	setFromEnv(&c.Vault.Path, "VAULT_PATH")
+	setFromEnv(&c.Vault.Key, "VAULT_KEY")
+	setFromEnv(&c.Vault.KeyFile, "VAULT_KEY_FILE")
+	return nil
+}
+
+// Validate reports the first invalid setting.
+func (c *Config) Validate() error {
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", c.Server.Port)
+	}
+	if c.Server.ShutdownTimeout < 0 {
+		return fmt.Errorf("invalid shutdown timeout: %s", time.Duration(c.Server.ShutdownTimeout))
+	}
+	for _, p := range c.Server.TrustedProxies {
+		if net.ParseIP(p) == nil {
+			if _, _, err := net.ParseCIDR(p); err != nil {
+				return fmt.Errorf("invalid trusted proxy: %q", p)
+			}
+		}
+	}
+	if c.Upstream.Scheme != "http" && c.Upstream.Scheme != "https" {
+		return fmt.Errorf("invalid upstream scheme: %q", c.Upstream.Scheme)
+	}
+	if c.Upstream.Host == "" {
+		return errors.New("upstream host is empty")
+	}
+	if c.Client.Proxy != "" {
+		if _, err := url.Parse(c.Client.Proxy); err != nil {
+			return fmt.Errorf("invalid proxy: %w", err)
+		}
+	}
+	// The client counts its timeout in whole milliseconds, 0 meaning none.
+	if time.Duration(c.Client.Timeout) < time.Millisecond {
+		return fmt.Errorf("invalid client timeout: %s", time.Duration(c.Client.Timeout))
+	}
+	if _, ok := tlsclient.MappedTLSClients[c.Client.Profile]; !ok {
+		return fmt.Errorf("unknown client profile: %q", c.Client.Profile)
+	}
+	if c.Client.UserAgent == "" {
+		return errors.New("user agent is empty")
+	}
+	if c.Client.RecycleInterval <= 0 {
+		return fmt.Errorf("invalid client recycle interval: %s", time.Duration(c.Client.RecycleInterval))
+	}
+	for _, h := range c.Headers.Response {
+		if strings.TrimSuffix(h, "*") == "" {
+			return fmt.Errorf("invalid response header: %q", h)
+		}
+	}
+	for i, p := range c.Headers.Request {
+		if p.Route == "" {
+			return fmt.Errorf("request header policy %d: route is empty", i)
+		}
+		for _, h := range append(append([]string{}, p.Allow...), p.Deny...) {
+			if h == "" {
+				return fmt.Errorf("request header policy %q: invalid header %q", p.Route, h)
+			}
+		}
+		for k := range p.Set {
+			if k == "" {
+				return fmt.Errorf("request header policy %q: empty header name in set", p.Route)
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	names := make(map[string]bool)
+	for i, k := range c.Auth.Keys {
+		// Limits, quotas and usage are kept per key name.
+		if k.Name == "" {
+			return fmt.Errorf("api key %d: name is empty", i)
+		}
+		if k.Name == AnonymousUser {
+			return fmt.Errorf("api key %d: name %q is reserved", i, k.Name)
+		}
+		if names[k.Name] {
+			return fmt.Errorf("api key %d (%s): duplicate name", i, k.Name)
+		}
+		names[k.Name] = true
+		if k.Key == "" {
+			return fmt.Errorf("api key %d (%s): key is empty", i, k.Name)
+		}
+		if seen[k.Key] {
+			return fmt.Errorf("api key %d (%s): duplicate key", i, k.Name)
+		}
+		seen[k.Key] = true
+		if (k.AccessToken == "") == (k.Token == "") {
+			return fmt.Errorf("api key %d (%s): exactly one of access_token and token must be set", i, k.Name)
+		}
+		if k.Token != "" && c.Vault.Path == "" {
+			return fmt.Errorf("api key %d (%s): token %q needs a vault", i, k.Name, k.Token)
+		}
+	}
+	if c.Auth.ExpiryWarning < 0 {
+		return fmt.Errorf("invalid token expiry warning: %s", time.Duration(c.Auth.ExpiryWarning))
+	}
+	for _, k := range c.Auth.AdminKeys {
+		if k == "" {
+			return errors.New("admin key is empty")
+		}
+	}
+	for name, l := range map[string]RateLimit{"per_key": c.Limits.PerKey, "per_ip": c.Limits.PerIP} {
+		if l.RequestsPerMinute < 0 || l.Burst < 0 {
+			return fmt.Errorf("invalid %s rate limit", name)
+		}
+	}
+	if c.Limits.MaxStreams < 0 || c.Limits.MaxStreamsPerKey < 0 {
+		return errors.New("invalid stream limit")
+	}
+	if c.Queue.Enabled && (c.Queue.MaxLength < 0 || c.Queue.WaitTimeout <= 0) {
+		return errors.New("invalid queue settings")
+	}
+	if c.Usage.FlushInterval <= 0 {
+		return fmt.Errorf("invalid usage flush interval: %s", time.Duration(c.Usage.FlushInterval))
+	}
+	for name, q := range c.Usage.Quotas.Keys {
+		if !names[name] {
+			return fmt.Errorf("usage quota for unknown api key %q", name)
+		}
+		if !q.valid() {
+			return fmt.Errorf("invalid usage quota for api key %q", name)
+		}
+	}
+	if !c.Usage.Quotas.Default.valid() {
+		return errors.New("invalid default usage quota")
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		return fmt.Errorf("invalid log format: %q", c.Log.Format)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return fmt.Errorf("invalid log level: %q", c.Log.Level)
+	}
+	if c.Tracing.Endpoint != "" {
+		u, err := url.Parse(c.Tracing.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid tracing endpoint: %q", c.Tracing.Endpoint)
+		}
+		if c.Tracing.ServiceName == "" {
+			return errors.New("tracing service name is empty")
+		}
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("invalid tracing sample ratio: %v", c.Tracing.SampleRatio)
+	}
+	if c.Health.ProxyTimeout <= 0 || c.Health.ErrorWindow < Duration(time.Second) || c.Health.MinRequests < 0 ||
+		c.Health.MaxErrorRate < 0 || c.Health.MaxErrorRate > 1 {
+		return errors.New("invalid health settings")
+	}
+	if c.Watch.Enabled && c.Watch.Interval <= 0 {
+		return fmt.Errorf("invalid config watch interval: %s", time.Duration(c.Watch.Interval))
+	}
+	if c.Vault.Path != "" && c.Vault.Key == "" && c.Vault.KeyFile == "" {
+		return errors.New("vault key is not set")
+	}
+	return nil
+}
+
+func (q Quota) valid() bool {
+	return q.DailyRequests >= 0 && q.DailyTokens >= 0 && q.MonthlyRequests >= 0 && q.MonthlyTokens >= 0
+}
+
+// Addr returns the listen address of the proxy.
+func (s Server) Addr() string {
+	return s.Host + ":" + strconv.Itoa(s.Port)
+}
+
+// BackendURL returns the upstream URL of a /backend-api path.
+func (u Upstream) BackendURL(path string, rawQuery string) string {
+	return u.url(u.BackendPrefix, path, rawQuery)
+}
+
+// PublicURL returns the upstream URL of a /public-api path.
+func (u Upstream) PublicURL(path string, rawQuery string) string {
+	return u.url(u.PublicPrefix, path, rawQuery)
+}
+
+func (u Upstream) url(prefix string, path string, rawQuery string) string {
+	s := u.Scheme + "://" + u.Host + strings.TrimSuffix(prefix, "/") + path
+	if rawQuery != "" {
+		s += "?" + rawQuery
+	}
+	return s
+}
+
+func setFromEnv(dst *string, key string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = v
+	}
+}
+
+// setListFromEnv splits a comma separated variable.
+func setListFromEnv(dst *[]string, key string) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+	list := make([]string, 0)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*dst = list
+}
+
+func setIntFromEnv(dst *int, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	*dst = n
+	return nil
+}
+
+func setBoolFromEnv(dst *bool, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	*dst = b
+	return nil
+}
+
+func setFloatFromEnv(dst *float64, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	*dst = f
+	return nil
+}
+
+func setDurationFromEnv(dst *Duration, key string) error {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return nil
+	}
+	if err := dst.UnmarshalText([]byte(v)); err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return nil
+}
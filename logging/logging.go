@@ -0,0 +1,73 @@
+// Package logging builds the structured logger of the proxy.
+//
+// Unless redaction is disabled, the values of sensitive attributes are
+// replaced with "[REDACTED]": authorization headers, tokens and cookies, and
+// message content such as prompts, completions and upstream bodies.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/flyingpot/chatgpt-proxy/config"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are the attribute keys, and header names, whose values are
+// redacted.
+var sensitiveKeys = map[string]bool{
+	"authorization":   true,
+	"x-authorization": true,
+	"cookie":          true,
+	"set-cookie":      true,
+	"access_token":    true,
+	"token":           true,
+	"email":           true,
+	"content":         true,
+	"parts":           true,
+	"prompt":          true,
+	"completion":      true,
+	"body":            true,
+}
+
+// New returns a logger writing to w in the configured format and level.
+func New(cfg config.Log, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", cfg.Level, err)
+	}
+	options := &slog.HandlerOptions{Level: level}
+	if cfg.Redact {
+		options.ReplaceAttr = redact
+	}
+
+	switch cfg.Format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", cfg.Format)
+	}
+}
+
+// Headers returns h as a log attribute. Sensitive headers are redacted by
+// the logger like any other sensitive attribute.
+func Headers(key string, h http.Header) slog.Attr {
+	attrs := make([]any, 0, len(h))
+	for name, values := range h {
+		attrs = append(attrs, slog.String(strings.ToLower(name), strings.Join(values, ", ")))
+	}
+	return slog.Group(key, attrs...)
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
@@ -1,9 +1,37 @@
 package main
 
 import (
-	"github.com/flyingpot/chatgpt-proxy/api"
+	"context"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/flyingpot/chatgpt-proxy/config"
+	"github.com/flyingpot/chatgpt-proxy/logging"
+	"github.com/flyingpot/chatgpt-proxy/server"
 )
 
 func main() {
-	api.Run()
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	logger, err := logging.New(cfg.Log, os.Stderr)
+	if err != nil {
+		log.Fatalf("failed to create logger: %v", err)
+	}
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// A second signal kills the process without waiting for streams.
+		<-ctx.Done()
+		stop()
+	}()
+	if err := server.Run(ctx, cfg); err != nil {
+		log.Fatalf("server stopped: %v", err)
+	}
 }
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	tokenExpiresInHeader = "X-Access-Token-Expires-In"
+	// tokenWarningInterval limits how often the same token is warned about.
+	tokenWarningInterval = time.Hour
+	tokenCheckInterval   = time.Hour
+)
+
+// accessTokenClaims are the JWT claims of an upstream access token the proxy
+// looks at. The signature is not verified: the upstream does that.
+type accessTokenClaims struct {
+	ExpiresAt int64 `json:"exp"`
+	Profile   struct {
+		Email string `json:"email"`
+	} `json:"https://api.openai.com/profile"`
+}
+
+// expiresIn returns the remaining lifetime of the token, or false if it has
+// no expiry.
+func (c *accessTokenClaims) expiresIn(now time.Time) (time.Duration, bool) {
+	if c.ExpiresAt == 0 {
+		return 0, false
+	}
+	return time.Unix(c.ExpiresAt, 0).Sub(now), true
+}
+
+// parseAccessToken decodes the claims of a JWT access token, with or without
+// the Bearer prefix.
+func parseAccessToken(token string) (*accessTokenClaims, error) {
+	token = strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	var claims accessTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// tokenWarnings remembers when each token was last warned about.
+type tokenWarnings struct {
+	mu   sync.Mutex
+	last map[[sha256.Size]byte]time.Time
+}
+
+// warn logs that a token is about to expire, at most once per
+// tokenWarningInterval for the same token.
+func (w *tokenWarnings) warn(logger *slog.Logger, token string, owner string, claims *accessTokenClaims, remaining time.Duration) {
+	sum := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	w.mu.Lock()
+	if w.last == nil {
+		w.last = make(map[[sha256.Size]byte]time.Time)
+	}
+	if now.Sub(w.last[sum]) < tokenWarningInterval {
+		w.mu.Unlock()
+		return
+	}
+	w.last[sum] = now
+	w.mu.Unlock()
+
+	logger.Warn("access token expires soon",
+		slog.String("owner", owner),
+		slog.String("email", claims.Profile.Email),
+		slog.Duration("expires_in", remaining.Round(time.Minute)))
+}
+
+// checkAccessToken rejects expired access tokens before they reach the
+// upstream and reports the remaining lifetime in X-Access-Token-Expires-In.
+// Tokens that are not JWTs are passed through.
+func (s *Server) checkAccessToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := accessToken(c)
+		claims, err := parseAccessToken(token)
+		if err != nil {
+			c.Next()
+			return
+		}
+		remaining, ok := claims.expiresIn(time.Now())
+		if !ok {
+			c.Next()
+			return
+		}
+		if remaining <= 0 {
+			abortWithError(c, apierror.New(apierror.CodeTokenExpired, 401,
+				"access token expired at "+time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339)))
+			return
+		}
+
+		c.Header(tokenExpiresInHeader, strconv.FormatInt(int64(remaining.Seconds()), 10))
+		if remaining < time.Duration(s.requestState(c).cfg.Auth.ExpiryWarning) {
+			owner := c.GetString(contextKeyName)
+			if owner == "" {
+				owner = c.ClientIP()
+			}
+			s.tokenWarnings.warn(requestLogger(c), token, owner, claims, remaining)
+		}
+		c.Next()
+	}
+}
+
+// checkStoredTokens warns about configured and vault tokens that expire
+// soon or have expired.
+func (s *Server) checkStoredTokens() {
+	cfg := s.current().cfg
+	for _, k := range cfg.Auth.Keys {
+		token := k.AccessToken
+		if k.Token != "" {
+			var ok bool
+			if s.vault != nil {
+				token, ok = s.vault.Get(k.Token)
+			}
+			if !ok {
+				s.logger.Warn("vault token of api key is missing", slog.String("key", k.Name), slog.String("vault_token", k.Token))
+				continue
+			}
+		}
+		claims, err := parseAccessToken(token)
+		if err != nil {
+			continue
+		}
+		if remaining, ok := claims.expiresIn(time.Now()); ok && remaining < time.Duration(cfg.Auth.ExpiryWarning) {
+			s.tokenWarnings.warn(s.logger, token, "api key "+k.Name, claims, remaining)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"time"
+
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+type putTokenRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// streamInfo describes an active stream in the admin API.
+type streamInfo struct {
+	*activeStream
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+// registerAdmin adds the /admin routes, which exist only when admin keys are
+// configured.
+func (s *Server) registerAdmin() {
+	if len(s.current().adminKeys) == 0 {
+		return
+	}
+	admin := s.engine.Group("/admin", s.authenticateAdmin())
+	admin.GET("/usage", s.getUsage)
+	admin.GET("/config", s.getConfig)
+	admin.POST("/config/reload", s.reloadConfig)
+	admin.POST("/client/rotate", s.rotateClient)
+	admin.GET("/streams", s.listStreams)
+	admin.DELETE("/streams/:id", s.cancelStream)
+	admin.GET("/upstream/errors", s.listUpstreamErrors)
+
+	if s.vault != nil {
+		admin.GET("/tokens", s.listTokens)
+		admin.PUT("/tokens/:name", s.putToken)
+		admin.DELETE("/tokens/:name", s.deleteToken)
+	}
+}
+
+func (s *Server) listTokens(c *gin.Context) {
+	c.JSON(200, gin.H{"tokens": s.vault.List()})
+}
+
+func (s *Server) putToken(c *gin.Context) {
+	var request putTokenRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, apierror.BadRequest(err))
+		return
+	}
+	if err := s.vault.Put(c.Param("name"), request.Token); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.Status(204)
+}
+
+func (s *Server) deleteToken(c *gin.Context) {
+	ok, err := s.vault.Delete(c.Param("name"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if !ok {
+		abortWithError(c, apierror.New(apierror.CodeNotFound, 404, "token not found"))
+		return
+	}
+	c.Status(204)
+}
+
+// getConfig answers with the running config, secrets redacted. The config
+// is rendered with the keys of the config file.
+func (s *Server) getConfig(c *gin.Context) {
+	cfg := s.requestState(c).cfg
+	data, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		abortWithError(c, apierror.Internal(err))
+		return
+	}
+	var rendered map[string]any
+	if err := yaml.Unmarshal(data, &rendered); err != nil {
+		abortWithError(c, apierror.Internal(err))
+		return
+	}
+	c.JSON(200, gin.H{"file": cfg.File(), "config": rendered})
+}
+
+func (s *Server) reloadConfig(c *gin.Context) {
+	sections, err := s.reload()
+	if err != nil {
+		abortWithError(c, apierror.New(apierror.CodeInvalidConfig, 400, err.Error()))
+		return
+	}
+	if sections == nil {
+		sections = []string{}
+	}
+	c.JSON(200, gin.H{"restart_required": sections})
+}
+
+func (s *Server) rotateClient(c *gin.Context) {
+	if err := s.RotateClient(); err != nil {
+		abortWithError(c, apierror.Internal(err))
+		return
+	}
+	c.Status(204)
+}
+
+func (s *Server) listStreams(c *gin.Context) {
+	now := time.Now()
+	streams := []streamInfo{}
+	for _, stream := range s.active.list() {
+		streams = append(streams, streamInfo{activeStream: stream, AgeSeconds: now.Sub(stream.Start).Seconds()})
+	}
+	c.JSON(200, gin.H{"streams": streams})
+}
+
+func (s *Server) cancelStream(c *gin.Context) {
+	if !s.active.cancel(c.Param("id")) {
+		abortWithError(c, apierror.New(apierror.CodeNotFound, 404, "stream not found"))
+		return
+	}
+	c.Status(204)
+}
+
+func (s *Server) listUpstreamErrors(c *gin.Context) {
+	c.JSON(200, gin.H{"errors": s.upstreamStats.recentErrors()})
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/sha256"
+	"strings"
+
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/flyingpot/chatgpt-proxy/config"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// contextKeyName holds the name of the proxy key of the request.
+	contextKeyName = "proxy_key_name"
+	// contextAccessToken holds the upstream access token of the request.
+	contextAccessToken = "access_token"
+)
+
+// adminKeys indexes the admin keys by their SHA-256.
+type adminKeys map[[sha256.Size]byte]bool
+
+func newAdminKeys(keys []string) adminKeys {
+	index := make(adminKeys, len(keys))
+	for _, k := range keys {
+		index[sha256.Sum256([]byte(k))] = true
+	}
+	return index
+}
+
+// apiKeys indexes the configured proxy keys by their SHA-256, so that the
+// lookup does not compare raw keys.
+type apiKeys map[[sha256.Size]byte]config.APIKey
+
+func newAPIKeys(keys []config.APIKey) apiKeys {
+	index := make(apiKeys, len(keys))
+	for _, k := range keys {
+		index[sha256.Sum256([]byte(k.Key))] = k
+	}
+	return index
+}
+
+// authenticate requires a valid proxy key when keys are configured and
+// swaps it for the upstream access token mapped to it. Without keys the
+// caller's token is forwarded unchanged.
+func (s *Server) authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys := s.requestState(c).keys
+		if len(keys) == 0 {
+			c.Next()
+			return
+		}
+
+		key := bearerToken(c)
+		apiKey, ok := keys[sha256.Sum256([]byte(key))]
+		if key == "" || !ok {
+			abortWithError(c, apierror.New(apierror.CodeInvalidAPIKey, 401, "invalid or missing proxy API key"))
+			return
+		}
+
+		token := apiKey.AccessToken
+		if apiKey.Token != "" {
+			if s.vault != nil {
+				token, ok = s.vault.Get(apiKey.Token)
+			}
+			if s.vault == nil || !ok {
+				abortWithError(c, apierror.New(apierror.CodeTokenNotFound, 401, "no access token stored for this API key"))
+				return
+			}
+		}
+
+		c.Set(contextKeyName, apiKey.Name)
+		c.Set(contextAccessToken, "Bearer "+strings.TrimPrefix(token, "Bearer "))
+		c.Next()
+	}
+}
+
+// authenticateAdmin requires one of the admin keys.
+func (s *Server) authenticateAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := bearerToken(c)
+		if key == "" || !s.requestState(c).adminKeys[sha256.Sum256([]byte(key))] {
+			abortWithError(c, apierror.New(apierror.CodeInvalidAPIKey, 401, "invalid or missing admin key"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// bearerToken returns the key presented by the caller, without the Bearer
+// prefix.
+func bearerToken(c *gin.Context) string {
+	return strings.TrimSpace(strings.TrimPrefix(GetAccessTokenFromHeader(c.Request.Header), "Bearer "))
+}
+
+// accessToken returns the Authorization value sent upstream.
+func accessToken(c *gin.Context) string {
+	if token := c.GetString(contextAccessToken); token != "" {
+		return token
+	}
+	return GetAccessTokenFromHeader(c.Request.Header)
+}
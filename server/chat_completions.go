@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/flyingpot/chatgpt-proxy/usage"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	gpt35Model        = "gpt-3.5"
+	gpt35UpstreamName = "text-davinci-002-render-sha"
+)
+
+// ChatCompletionRequest is the subset of the OpenAI Chat Completions request
+// that can be mapped onto the web backend.
+type ChatCompletionRequest struct {
+	Model    string                  `json:"model"`
+	Messages []ChatCompletionMessage `json:"messages"`
+	Stream   bool                    `json:"stream"`
+}
+
+type ChatCompletionMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ChatCompletionResponse struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []ChatCompletionChoice `json:"choices"`
+	Usage   *ChatCompletionUsage   `json:"usage,omitempty"`
+}
+
+type ChatCompletionChoice struct {
+	Index        int                    `json:"index"`
+	Message      *ChatCompletionMessage `json:"message,omitempty"`
+	Delta        *ChatCompletionDelta   `json:"delta,omitempty"`
+	FinishReason *string                `json:"finish_reason"`
+}
+
+type ChatCompletionDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type ChatCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func (s *Server) chatCompletions(c *gin.Context) {
+	var ccRequest ChatCompletionRequest
+	if err := c.ShouldBindJSON(&ccRequest); err != nil {
+		abortWithError(c, apierror.BadRequest(err))
+		return
+	}
+	if len(ccRequest.Messages) == 0 {
+		abortWithError(c, apierror.New(apierror.CodeInvalidRequest, 400, "messages is empty"))
+		return
+	}
+
+	cRequest := newConversationRequest(ccRequest)
+	if err := s.prepareConversation(c.Request.Context(), &cRequest); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	jsonBytes, _ := json.Marshal(cRequest)
+
+	request, err := s.newUpstreamRequest(c, "POST", "/conversation", s.requestState(c).cfg.Upstream.BackendURL("/conversation", ""), bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "text/event-stream")
+
+	response, err := s.doUpstream(c, "/conversation", request)
+	if err != nil {
+		abortWithError(c, apierror.Transport(err))
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode > 299 {
+		s.relayUpstreamError(c, "/conversation", response)
+		return
+	}
+
+	id := "chatcmpl-" + randomHex(12)
+	created := time.Now().Unix()
+	var prompt strings.Builder
+	for _, m := range ccRequest.Messages {
+		prompt.WriteString(m.Content)
+	}
+	_, span := s.startSpan(c.Request.Context(), "stream", attribute.Bool("stream", ccRequest.Stream))
+	if ccRequest.Stream {
+		text := streamChatCompletion(c, response.Body, id, created, ccRequest.Model)
+		span.SetAttributes(attribute.Int("stream.completion_characters", utf8.RuneCountInString(text)))
+		endSpan(span, nil)
+		s.recordUsage(c, cRequest.Model, prompt.String(), text)
+		return
+	}
+
+	text, err := readConversationText(response.Body, nil)
+	span.SetAttributes(attribute.Int("stream.completion_characters", utf8.RuneCountInString(text)))
+	endSpan(span, err)
+	s.recordUsage(c, cRequest.Model, prompt.String(), text)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	stop := "stop"
+	c.JSON(200, ChatCompletionResponse{
+		ID:      id,
+		Object:  "chat.completion",
+		Created: created,
+		Model:   ccRequest.Model,
+		Choices: []ChatCompletionChoice{{
+			Message:      &ChatCompletionMessage{Role: "assistant", Content: text},
+			FinishReason: &stop,
+		}},
+		Usage: estimateUsage(prompt.String(), text),
+	})
+}
+
+// estimateUsage reports the token counts of prompt and completion as
+// estimated for the usage accounting.
+func estimateUsage(prompt string, completion string) *ChatCompletionUsage {
+	promptTokens := int(usage.EstimateTokens(prompt))
+	completionTokens := int(usage.EstimateTokens(completion))
+	return &ChatCompletionUsage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+// streamChatCompletion relays an upstream /conversation stream as chat
+// completion chunks and returns the text streamed. A stream that fails or
+// ends before [DONE] is closed with an error event instead of the stop chunk
+// and [DONE], so that callers can tell a truncated answer from a complete
+// one.
+func streamChatCompletion(c *gin.Context, body io.Reader, id string, created int64, model string) string {
+	c.Writer.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	c.Status(200)
+
+	chunk := func(delta ChatCompletionDelta, finishReason *string) bool {
+		jsonBytes, _ := json.Marshal(ChatCompletionResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []ChatCompletionChoice{{Delta: &delta, FinishReason: finishReason}},
+		})
+		if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", jsonBytes); err != nil {
+			requestLogger(c).Warn("error writing to client", slog.Any("error", err))
+			return false
+		}
+		c.Writer.Flush()
+		return true
+	}
+
+	if !chunk(ChatCompletionDelta{Role: "assistant"}, nil) {
+		return ""
+	}
+	clientGone := false
+	text, err := readConversationText(body, func(delta string) bool {
+		clientGone = !chunk(ChatCompletionDelta{Content: delta}, nil)
+		return !clientGone
+	})
+	if clientGone {
+		return text
+	}
+	if err != nil {
+		logStreamError(c, err)
+		writeErrorEvent(c, apierror.From(err))
+		return text
+	}
+	stop := "stop"
+	if chunk(ChatCompletionDelta{}, &stop) {
+		fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+		c.Writer.Flush()
+	}
+	return text
+}
+
+// readConversationText reads an upstream /conversation stream and returns the
+// final assistant text. onDelta, if set, is called with each newly appended
+// piece of text and stops the read by returning false. A stream that ends
+// before [DONE] is an upstream_stream_error, as in the aggregate mode.
+func readConversationText(body io.Reader, onDelta func(string) bool) (string, error) {
+	var text string
+	decoder := NewEventDecoder(body)
+	for {
+		event, err := decoder.Next()
+		if err == io.EOF {
+			return text, apierror.Stream("upstream stream ended unexpectedly")
+		}
+		if err != nil {
+			return text, apierror.Stream(err.Error())
+		}
+		if event.Done {
+			return text, nil
+		}
+		if event.Error != "" {
+			return text, apierror.Stream(event.Error)
+		}
+		if event.Role != "assistant" {
+			continue
+		}
+
+		part := event.Text()
+		if strings.HasPrefix(part, text) && len(part) > len(text) {
+			delta := part[len(text):]
+			text = part
+			if onDelta != nil && !onDelta(delta) {
+				return text, nil
+			}
+		}
+	}
+}
+
+func newConversationRequest(ccRequest ChatCompletionRequest) CreateConversationRequest {
+	messages := make([]Message, 0, len(ccRequest.Messages))
+	for _, m := range ccRequest.Messages {
+		role := m.Role
+		if role == "" {
+			role = defaultRole
+		}
+		messages = append(messages, Message{
+			Author:  Author{Role: role},
+			Content: Content{ContentType: "text", Parts: []string{m.Content}},
+			ID:      newUUID(),
+		})
+	}
+
+	return CreateConversationRequest{
+		Action:                     "next",
+		Messages:                   messages,
+		Model:                      upstreamModel(ccRequest.Model),
+		ParentMessageID:            newUUID(),
+		HistoryAndTrainingDisabled: true,
+	}
+}
+
+// upstreamModel maps an OpenAI API model name onto the web backend name.
+func upstreamModel(model string) string {
+	switch {
+	case model == "", strings.HasPrefix(model, gpt35Model):
+		return gpt35UpstreamName
+	case strings.HasPrefix(model, gpt4Model):
+		return gpt4Model
+	default:
+		return model
+	}
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
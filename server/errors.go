@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/gin-gonic/gin"
+)
+
+// statusClientClosedRequest is logged for requests whose caller went away
+// before they were answered.
+const statusClientClosedRequest = 499
+
+// relayedErrorHeaders are copied from a failed upstream response.
+var relayedErrorHeaders = []string{"Retry-After"}
+
+// upstreamError reads a failed upstream response into an error. The body is
+// logged at debug level only.
+func upstreamError(logger *slog.Logger, response *http.Response) *apierror.Error {
+	statusText := http.StatusText(response.StatusCode)
+	bodyBytes, err := io.ReadAll(response.Body)
+	if err != nil {
+		logger.Error("could not read upstream response body", slog.Any("error", err))
+	}
+	e := apierror.Upstream(response.StatusCode, statusText, response.Header.Get("Content-Type"), bodyBytes)
+	logger.Warn("upstream request failed", slog.Int("upstream_status", response.StatusCode), slog.String("message", e.Message))
+	logger.Debug("upstream error response", slog.Int("upstream_status", response.StatusCode), slog.String("body", string(bodyBytes)))
+	return e
+}
+
+// relayUpstreamError answers the caller with the error of a failed upstream
+// response to route.
+func (s *Server) relayUpstreamError(c *gin.Context, route string, response *http.Response) {
+	for _, key := range relayedErrorHeaders {
+		if v := response.Header.Get(key); v != "" {
+			c.Header(key, v)
+		}
+	}
+	e := upstreamError(requestLogger(c), response)
+	s.recordUpstreamError(c, route, response.StatusCode, e)
+	abortWithError(c, e)
+}
+
+// recordUpstreamError keeps e among the recent upstream errors listed by
+// the admin API. status is the upstream status, 0 if there was no response.
+func (s *Server) recordUpstreamError(c *gin.Context, route string, status int, e *apierror.Error) {
+	s.upstreamStats.recordError(upstreamFailure{
+		Time:      time.Now(),
+		RequestID: c.GetString(contextRequestID),
+		Route:     route,
+		Status:    status,
+		Code:      e.Code,
+		Message:   e.Message,
+	})
+}
+
+// abortWithError answers the caller with err rendered as an apierror
+// response. Nothing is answered to a caller that has disconnected. A
+// response that already started streaming, e.g. to report the queue
+// position, gets the error as its last event.
+func abortWithError(c *gin.Context, err error) {
+	if c.Request.Context().Err() != nil {
+		requestLogger(c).Info("caller disconnected", slog.Any("error", err))
+		c.AbortWithStatus(statusClientClosedRequest)
+		return
+	}
+	e := apierror.From(err)
+	if e.Code == apierror.CodeInternal || e.Err != nil {
+		requestLogger(c).Error("request failed", slog.String("code", string(e.Code)), slog.Any("error", e))
+	}
+	if c.Writer.Written() {
+		writeErrorEvent(c, e)
+		c.Abort()
+		return
+	}
+	if e.RetryAfter > 0 {
+		c.Header("Retry-After", retryAfterSeconds(e.RetryAfter))
+	}
+	c.AbortWithStatusJSON(e.Status, e.Response())
+}
+
+// writeErrorEvent sends e as an event of a response that is already
+// streaming, in the error envelope of the OpenAI streaming API.
+func writeErrorEvent(c *gin.Context, e *apierror.Error) {
+	jsonBytes, _ := json.Marshal(e.Response())
+	fmt.Fprintf(c.Writer, "data: %s\n\n", jsonBytes)
+	c.Writer.Flush()
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/acheong08/funcaptcha"
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"io"
+	"log/slog"
+	nethttp "net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultRole = "user"
+	gpt4Model   = "gpt-4"
+)
+
+type CreateConversationRequest struct {
+	Action                     string    `json:"action"`
+	Messages                   []Message `json:"messages"`
+	Model                      string    `json:"model"`
+	ParentMessageID            string    `json:"parent_message_id"`
+	ConversationID             *string   `json:"conversation_id"`
+	PluginIDs                  []string  `json:"plugin_ids"`
+	TimezoneOffsetMin          int       `json:"timezone_offset_min"`
+	ArkoseToken                string    `json:"arkose_token"`
+	HistoryAndTrainingDisabled bool      `json:"history_and_training_disabled"`
+	AutoContinue               bool      `json:"auto_continue"`
+}
+
+type Message struct {
+	Author  Author  `json:"author"`
+	Content Content `json:"content"`
+	ID      string  `json:"id"`
+}
+
+type Author struct {
+	Role string `json:"role"`
+}
+
+type Content struct {
+	ContentType string   `json:"content_type"`
+	Parts       []string `json:"parts"`
+}
+
+func (s *Server) proxy(c *gin.Context) {
+	st := s.requestState(c)
+	// Remove _cfuvid cookie from session
+	st.jar.SetCookies(c.Request.URL, []*http.Cookie{})
+
+	var requestUrl string
+	var err error
+	var requestMethod string
+	var request *http.Request
+	var response *http.Response
+
+	rawQuery := upstreamQuery(c.Request.URL.RawQuery)
+	if c.Param("path") == "/conversation_limit" {
+		requestUrl = st.cfg.Upstream.PublicURL(c.Param("path"), rawQuery)
+	} else {
+		requestUrl = st.cfg.Upstream.BackendURL(c.Param("path"), rawQuery)
+	}
+	requestMethod = c.Request.Method
+
+	var body io.Reader
+	var cRequest CreateConversationRequest
+	if c.Param("path") == "/conversation" {
+		if err := c.ShouldBindJSON(&cRequest); err != nil {
+			abortWithError(c, apierror.BadRequest(err))
+			return
+		}
+
+		if err := s.prepareConversation(c.Request.Context(), &cRequest); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		jsonBytes, _ := json.Marshal(cRequest)
+		body = bytes.NewBuffer(jsonBytes)
+	} else {
+		body = c.Request.Body
+	}
+
+	request, err = s.newUpstreamRequest(c, requestMethod, c.Param("path"), requestUrl, body)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	response, err = s.doUpstream(c, c.Param("path"), request)
+	if err != nil {
+		abortWithError(c, apierror.Transport(err))
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode > 299 {
+		st.copyResponseHeaders(c, response)
+		s.relayUpstreamError(c, c.Param("path"), response)
+		return
+	}
+	// Get status code
+	c.Status(response.StatusCode)
+	st.copyResponseHeaders(c, response)
+
+	if c.Param("path") == "/conversation" {
+		var completion completion
+		mode := streamMode(c)
+		_, span := s.startSpan(c.Request.Context(), "stream", attribute.String("stream.mode", mode))
+		switch mode {
+		case streamModeDelta:
+			streamDelta(c, response.Body, completion.observe)
+		case streamModeAggregate:
+			aggregateConversation(c, response.Body, completion.observe)
+		default:
+			relayContentType(c, response)
+			streamFull(c, response.Body, completion.observe)
+		}
+		span.SetAttributes(attribute.Int("stream.completion_characters", utf8.RuneCountInString(completion.text)))
+		endSpan(span, nil)
+		s.recordUsage(c, cRequest.Model, conversationPrompt(&cRequest), completion.text)
+		return
+	}
+
+	relayContentType(c, response)
+	buf := make([]byte, 4096)
+	for {
+		n, err := response.Body.Read(buf)
+		if n > 0 {
+			_, writeErr := c.Writer.Write(buf[:n])
+			if writeErr != nil {
+				requestLogger(c).Warn("error writing to client", slog.Any("error", writeErr))
+				break
+			}
+		}
+
+		c.Writer.Flush()
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			requestLogger(c).Error("error reading upstream response", slog.Any("error", err))
+			break
+		}
+	}
+}
+
+// relayContentType answers with the Content-Type of the upstream response,
+// for the paths that relay its body unchanged.
+func relayContentType(c *gin.Context, response *http.Response) {
+	if contentType := response.Header.Get("Content-Type"); contentType != "" {
+		c.Header("Content-Type", contentType)
+	}
+}
+
+// prepareConversation fills in the defaults the web backend expects and
+// attaches an arkose token for gpt-4 models.
+func (s *Server) prepareConversation(ctx context.Context, cRequest *CreateConversationRequest) error {
+	if cRequest.ConversationID == nil || *cRequest.ConversationID == "" {
+		cRequest.ConversationID = nil
+	}
+
+	if len(cRequest.Messages) != 0 {
+		if cRequest.Messages[0].Author.Role == "" {
+			cRequest.Messages[0].Author.Role = defaultRole
+		}
+	}
+
+	if strings.HasPrefix(cRequest.Model, gpt4Model) {
+		start := time.Now()
+		_, span := s.startSpan(ctx, "arkose.token", attribute.String("model", cRequest.Model))
+		arkoseToken, err := funcaptcha.GetOpenAIToken()
+		endSpan(span, err)
+		s.metrics.observeArkose(start, err)
+		if err != nil {
+			return apierror.Arkose(err)
+		}
+		cRequest.ArkoseToken = arkoseToken
+	}
+	return nil
+}
+
+// doUpstream sends request to the upstream route and records its latency.
+func (s *Server) doUpstream(c *gin.Context, route string, request *http.Request) (*http.Response, error) {
+	_, span := s.tracer.Start(c.Request.Context(), "upstream "+routeLabel(route),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", request.Method),
+			attribute.String("server.address", request.URL.Host),
+			attribute.String("url.path", request.URL.Path),
+		))
+	start := time.Now()
+	response, err := s.requestState(c).client.Do(request)
+	s.metrics.observeUpstream(route, start, response)
+	switch {
+	case response != nil:
+		s.upstreamStats.record(response.StatusCode, nil)
+	case request.Context().Err() == nil:
+		// Requests cancelled by the caller or the proxy are no upstream
+		// failures.
+		s.upstreamStats.record(0, err)
+		s.recordUpstreamError(c, route, 0, apierror.Transport(err))
+	}
+	if response != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+		if response.StatusCode > 299 {
+			span.SetStatus(codes.Error, response.Status)
+		}
+	}
+	endSpan(span, err)
+	return response, err
+}
+
+// newUpstreamRequest creates a request to the upstream route carrying the
+// caller's access token and the caller headers the route's policy allows.
+func (s *Server) newUpstreamRequest(c *gin.Context, method string, route string, url string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(upstreamContext(c), method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	st := s.requestState(c)
+	st.copyRequestHeaders(request, c.Request.Header, route)
+	request.Header.Set("Authorization", accessToken(c))
+	request.Header.Set("user-agent", st.cfg.Client.UserAgent)
+	st.setRequestHeaders(request, route)
+	return request, nil
+}
+
+func GetAccessTokenFromHeader(header nethttp.Header) string {
+	// pandora will pass X-Authorization header
+	// but maybe other project will use Authorization header to pass access token
+	xAuth := header.Get("X-Authorization")
+	if xAuth == "" {
+		return header.Get("Authorization")
+	} else {
+		return xAuth
+	}
+}
+
+func Cors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		method := c.Request.Method
+
+		c.Header("Access-Control-Allow-Origin", "*")
+		c.Header("Access-Control-Allow-Headers", "Accept,Origin,Content-Length,Content-Type,Authorization,X-Authorization,X-Stream-Mode,X-Queue-Events,X-Request-ID,X-Requested-With,Access-Control-Request-Method,Access-Control-Request-Headers,Content-Disposition")
+		c.Header("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,HEAD,OPTIONS")
+		c.Header("Access-Control-Expose-Headers", "Content-Length, Access-Control-Allow-Origin, Access-Control-Allow-Headers, Content-Type, Retry-After, X-Access-Token-Expires-In, X-Queue-Position, X-Request-ID")
+		c.Header("Access-Control-Allow-Credentials", "true")
+
+		if method == "OPTIONS" {
+			c.AbortWithStatus(http.StatusNoContent)
+		}
+		c.Next()
+	}
+}
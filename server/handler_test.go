@@ -0,0 +1,364 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/flyingpot/chatgpt-proxy/config"
+)
+
+// fakeUpstream serves the web backend routes the proxy relays to. The
+// conversation route streams "Hel", "Hello" and [DONE], unless the model
+// asks for a failure:
+//
+//   - "fail" is answered with 429 Too Many Requests,
+//   - "error" reports an error inside the stream after the first frame,
+//   - "truncate" ends the stream without [DONE].
+func fakeUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	return holdingUpstream(t, nil)
+}
+
+// holdingUpstream is fakeUpstream calling hold, if set, with the model of
+// every conversation before answering it.
+func holdingUpstream(t *testing.T, hold func(r *nethttp.Request, model string)) *httptest.Server {
+	t.Helper()
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/backend-api/models", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Set-Cookie", "session=secret")
+		fmt.Fprint(w, `{"models":[{"slug":"gpt-4"}]}`)
+	})
+	mux.HandleFunc("/backend-api/conversation", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		var request CreateConversationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("upstream got an invalid conversation request: %v", err)
+			nethttp.Error(w, err.Error(), 400)
+			return
+		}
+		if hold != nil {
+			hold(r, request.Model)
+		}
+		if request.Model == "fail" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(429)
+			fmt.Fprint(w, `{"detail":"Too many requests in 1 hour. Try again later."}`)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: %s\n\n", messageFrame("m1", "assistant", "Hel"))
+		if request.Model == "error" {
+			fmt.Fprint(w, "data: {\"message\": null, \"error\": \"Something went wrong\"}\n\n")
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", messageFrame("m1", "assistant", "Hello"))
+		if request.Model != "truncate" {
+			fmt.Fprint(w, "data: [DONE]\n\n")
+		}
+	})
+	upstream := httptest.NewServer(mux)
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// newTestServer returns a proxy relaying to upstream, with the default
+// config changed by configure.
+func newTestServer(t *testing.T, upstream *httptest.Server, configure ...func(cfg *config.Config)) *Server {
+	t.Helper()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Upstream.Scheme = u.Scheme
+	cfg.Upstream.Host = u.Host
+	cfg.Log.Level = "error"
+	for _, f := range configure {
+		f(cfg)
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func serve(s *Server, method string, target string, body string, header map[string]string) *httptest.ResponseRecorder {
+	return serveContext(context.Background(), s, method, target, body, header)
+}
+
+// serveContext is serve with a request canceled along with ctx.
+func serveContext(ctx context.Context, s *Server, method string, target string, body string, header map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body)).WithContext(ctx)
+	request.Header.Set("Authorization", "Bearer token")
+	for key, value := range header {
+		request.Header.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	s.Handler().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func conversationBody(model string) string {
+	return `{"action": "next", "model": "` + model + `", "messages": [{"content": {"content_type": "text", "parts": ["hi"]}}]}`
+}
+
+func decodeError(t *testing.T, recorder *httptest.ResponseRecorder) apierror.Body {
+	t.Helper()
+	var response apierror.Response
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid error response %q: %v", recorder.Body, err)
+	}
+	return response.Error
+}
+
+func TestProxyPassthrough(t *testing.T) {
+	s := newTestServer(t, fakeUpstream(t))
+	recorder := serve(s, "GET", "/api/models", "", nil)
+
+	if recorder.Code != 200 {
+		t.Fatalf("status = %d, want 200", recorder.Code)
+	}
+	if got := recorder.Body.String(); got != `{"models":[{"slug":"gpt-4"}]}` {
+		t.Errorf("body = %q", got)
+	}
+	if got := recorder.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want the upstream's", got)
+	}
+	if got := recorder.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want the upstream's", got)
+	}
+	if got := recorder.Header().Get("Set-Cookie"); got != "" {
+		t.Errorf("Set-Cookie = %q, want it dropped", got)
+	}
+}
+
+func TestProxyConversationFull(t *testing.T) {
+	s := newTestServer(t, fakeUpstream(t))
+	recorder := serve(s, "POST", "/api/conversation", conversationBody("gpt-3.5"), nil)
+
+	if recorder.Code != 200 {
+		t.Fatalf("status = %d, want 200", recorder.Code)
+	}
+	if got := recorder.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want the upstream's", got)
+	}
+	events := decodeAll(t, recorder.Body.String())
+	if len(events) != 3 || events[0].Text() != "Hel" || events[1].Text() != "Hello" || !events[2].Done {
+		t.Errorf("body = %q, want the upstream frames", recorder.Body)
+	}
+}
+
+func TestProxyConversationDelta(t *testing.T) {
+	s := newTestServer(t, fakeUpstream(t))
+	recorder := serve(s, "POST", "/api/conversation?stream_mode=delta", conversationBody("gpt-3.5"), nil)
+
+	if recorder.Code != 200 {
+		t.Fatalf("status = %d, want 200", recorder.Code)
+	}
+	if got := recorder.Header().Get("Content-Type"); got != "text/event-stream; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	events := decodeAll(t, recorder.Body.String())
+	if len(events) != 3 || events[0].Text() != "Hel" || events[1].Text() != "lo" || !events[2].Done {
+		t.Errorf("body = %q, want the deltas", recorder.Body)
+	}
+	if events[1].MessageID != "m1" {
+		t.Errorf("delta message id = %q, want m1", events[1].MessageID)
+	}
+}
+
+func TestProxyConversationAggregate(t *testing.T) {
+	s := newTestServer(t, fakeUpstream(t))
+	recorder := serve(s, "POST", "/api/conversation", conversationBody("gpt-3.5"), map[string]string{streamModeHeader: "aggregate"})
+
+	if recorder.Code != 200 {
+		t.Fatalf("status = %d, want 200: %s", recorder.Code, recorder.Body)
+	}
+	if got := recorder.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want JSON", got)
+	}
+	var result struct {
+		Message struct {
+			Content Content `json:"content"`
+		} `json:"message"`
+		ConversationID  string `json:"conversation_id"`
+		ParentMessageID string `json:"parent_message_id"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid response %q: %v", recorder.Body, err)
+	}
+	if strings.Join(result.Message.Content.Parts, "") != "Hello" || result.ConversationID != "c1" || result.ParentMessageID != "m1" {
+		t.Errorf("response = %+v", result)
+	}
+}
+
+func TestProxyConversationAggregateErrors(t *testing.T) {
+	for _, model := range []string{"error", "truncate"} {
+		t.Run(model, func(t *testing.T) {
+			s := newTestServer(t, fakeUpstream(t))
+			recorder := serve(s, "POST", "/api/conversation?stream_mode=aggregate", conversationBody(model), nil)
+
+			if recorder.Code != 502 {
+				t.Fatalf("status = %d, want 502", recorder.Code)
+			}
+			if got := recorder.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want JSON", got)
+			}
+			if e := decodeError(t, recorder); e.Code != apierror.CodeUpstreamStream {
+				t.Errorf("code = %q, want %q", e.Code, apierror.CodeUpstreamStream)
+			}
+		})
+	}
+}
+
+func TestProxyUpstreamError(t *testing.T) {
+	s := newTestServer(t, fakeUpstream(t))
+	recorder := serve(s, "POST", "/api/conversation", conversationBody("fail"), nil)
+
+	if recorder.Code != 429 {
+		t.Fatalf("status = %d, want 429", recorder.Code)
+	}
+	if got := recorder.Header().Get("Retry-After"); got != "7" {
+		t.Errorf("Retry-After = %q, want the upstream's", got)
+	}
+	e := decodeError(t, recorder)
+	if e.Status != 429 || !strings.Contains(string(e.Upstream), "Too many requests") {
+		t.Errorf("error = %+v, want the upstream error relayed", e)
+	}
+}
+
+func chatCompletionBody(model string, stream bool) string {
+	return fmt.Sprintf(`{"model": %q, "stream": %v, "messages": [{"role": "user", "content": "hi there"}]}`, model, stream)
+}
+
+func TestChatCompletions(t *testing.T) {
+	s := newTestServer(t, fakeUpstream(t))
+	recorder := serve(s, "POST", "/v1/chat/completions", chatCompletionBody("gpt-3.5-turbo", false), nil)
+
+	if recorder.Code != 200 {
+		t.Fatalf("status = %d, want 200: %s", recorder.Code, recorder.Body)
+	}
+	var response ChatCompletionResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %q: %v", recorder.Body, err)
+	}
+	if len(response.Choices) != 1 || response.Choices[0].Message.Content != "Hello" {
+		t.Errorf("choices = %+v", response.Choices)
+	}
+	want := ChatCompletionUsage{PromptTokens: 2, CompletionTokens: 2, TotalTokens: 4}
+	if response.Usage == nil || *response.Usage != want {
+		t.Errorf("usage = %+v, want %+v", response.Usage, want)
+	}
+}
+
+func TestChatCompletionsErrors(t *testing.T) {
+	for _, model := range []string{"error", "truncate"} {
+		t.Run(model, func(t *testing.T) {
+			s := newTestServer(t, fakeUpstream(t))
+			recorder := serve(s, "POST", "/v1/chat/completions", chatCompletionBody(model, false), nil)
+
+			if recorder.Code != 502 {
+				t.Fatalf("status = %d, want 502", recorder.Code)
+			}
+			if e := decodeError(t, recorder); e.Code != apierror.CodeUpstreamStream {
+				t.Errorf("code = %q, want %q", e.Code, apierror.CodeUpstreamStream)
+			}
+		})
+	}
+}
+
+// chatCompletionEvents returns the data of every event of a chat completion
+// stream.
+func chatCompletionEvents(t *testing.T, body io.Reader) []string {
+	t.Helper()
+	var data []string
+	decoder := NewEventDecoder(body)
+	for {
+		event, err := decoder.Next()
+		if err == io.EOF {
+			return data
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, string(event.Data))
+	}
+}
+
+func TestChatCompletionsStream(t *testing.T) {
+	s := newTestServer(t, fakeUpstream(t))
+	recorder := serve(s, "POST", "/v1/chat/completions", chatCompletionBody("gpt-3.5-turbo", true), nil)
+
+	if recorder.Code != 200 {
+		t.Fatalf("status = %d, want 200", recorder.Code)
+	}
+	events := chatCompletionEvents(t, recorder.Body)
+	if len(events) != 5 || events[4] != doneData {
+		t.Fatalf("events = %q, want role, two deltas, stop and [DONE]", events)
+	}
+	var text string
+	for _, data := range events[1:3] {
+		var chunk ChatCompletionResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatal(err)
+		}
+		text += chunk.Choices[0].Delta.Content
+	}
+	if text != "Hello" {
+		t.Errorf("streamed text = %q, want Hello", text)
+	}
+	var stop ChatCompletionResponse
+	if err := json.Unmarshal([]byte(events[3]), &stop); err != nil {
+		t.Fatal(err)
+	}
+	if reason := stop.Choices[0].FinishReason; reason == nil || *reason != "stop" {
+		t.Errorf("finish_reason = %v, want stop", reason)
+	}
+}
+
+func TestChatCompletionsStreamErrors(t *testing.T) {
+	for _, model := range []string{"error", "truncate"} {
+		t.Run(model, func(t *testing.T) {
+			s := newTestServer(t, fakeUpstream(t))
+			recorder := serve(s, "POST", "/v1/chat/completions", chatCompletionBody(model, true), nil)
+
+			events := chatCompletionEvents(t, recorder.Body)
+			if len(events) == 0 {
+				t.Fatal("empty stream")
+			}
+			last := events[len(events)-1]
+			var response apierror.Response
+			if err := json.Unmarshal([]byte(last), &response); err != nil || response.Error.Code != apierror.CodeUpstreamStream {
+				t.Errorf("last event = %q, want an upstream_stream_error", last)
+			}
+			for _, data := range events {
+				if data == doneData || strings.Contains(data, `"finish_reason":"stop"`) {
+					t.Errorf("stream of a failed answer contains %q", data)
+				}
+			}
+		})
+	}
+}
+
+func TestUsageModelNames(t *testing.T) {
+	s := newTestServer(t, fakeUpstream(t))
+	serve(s, "POST", "/v1/chat/completions", chatCompletionBody("gpt-3.5-turbo", false), nil)
+	serve(s, "POST", "/api/conversation", conversationBody(gpt35UpstreamName), nil)
+
+	models := s.usage.Snapshot()[config.AnonymousUser].Models
+	if len(models) != 1 || models[gpt35UpstreamName].Requests != 2 {
+		t.Errorf("per model usage = %+v, want both requests under %s", models, gpt35UpstreamName)
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	nethttp "net/http"
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/flyingpot/chatgpt-proxy/config"
+	"github.com/gin-gonic/gin"
+)
+
+// skippedRequestHeaders are never copied from the caller: they are hop by
+// hop, describe the inbound connection or are set by the proxy and its
+// client itself.
+var skippedRequestHeaders = newHeaderMatcher([]string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-*",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Host",
+	"Content-Length",
+	"Accept-Encoding",
+	"Authorization",
+	"X-Authorization",
+	streamModeHeader,
+	queueEventsHeader,
+})
+
+// headerPolicy is the compiled form of a config.HeaderPolicy.
+type headerPolicy struct {
+	route string
+	allow headerMatcher
+	deny  headerMatcher
+	set   map[string]string
+}
+
+func newHeaderPolicies(policies []config.HeaderPolicy) []headerPolicy {
+	compiled := make([]headerPolicy, 0, len(policies))
+	for _, p := range policies {
+		compiled = append(compiled, headerPolicy{
+			route: p.Route,
+			allow: newHeaderMatcher(p.Allow),
+			deny:  newHeaderMatcher(p.Deny),
+			set:   p.Set,
+		})
+	}
+	return compiled
+}
+
+// headerMatcher matches header names against a list of names, where a
+// trailing "*" matches any suffix. Matching is case insensitive.
+type headerMatcher struct {
+	names    map[string]bool
+	prefixes []string
+}
+
+func newHeaderMatcher(patterns []string) headerMatcher {
+	m := headerMatcher{names: make(map[string]bool)}
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if strings.HasSuffix(p, "*") {
+			m.prefixes = append(m.prefixes, strings.TrimSuffix(p, "*"))
+		} else {
+			m.names[p] = true
+		}
+	}
+	return m
+}
+
+func (m headerMatcher) match(name string) bool {
+	name = strings.ToLower(name)
+	if m.names[name] {
+		return true
+	}
+	for _, p := range m.prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestPolicy returns the first policy matching route, or nil.
+func (st *state) requestPolicy(route string) *headerPolicy {
+	for i, p := range st.requestHeaders {
+		if matchRoute(p.route, route) {
+			return &st.requestHeaders[i]
+		}
+	}
+	return nil
+}
+
+func matchRoute(pattern string, route string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(route, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == route
+}
+
+// copyRequestHeaders forwards the caller headers allowed on route.
+func (st *state) copyRequestHeaders(request *http.Request, header nethttp.Header, route string) {
+	policy := st.requestPolicy(route)
+	if policy == nil {
+		return
+	}
+	for key, values := range header {
+		if skippedRequestHeaders.match(key) || !policy.allow.match(key) || policy.deny.match(key) {
+			continue
+		}
+		for _, v := range values {
+			request.Header.Add(key, v)
+		}
+	}
+}
+
+// setRequestHeaders adds the static headers configured for route.
+func (st *state) setRequestHeaders(request *http.Request, route string) {
+	policy := st.requestPolicy(route)
+	if policy == nil {
+		return
+	}
+	for key, value := range policy.set {
+		request.Header.Set(key, value)
+	}
+}
+
+// copyResponseHeaders relays the allowlisted upstream response headers to
+// the caller.
+func (st *state) copyResponseHeaders(c *gin.Context, response *http.Response) {
+	for key, values := range response.Header {
+		if !st.responseHeaders.match(key) {
+			continue
+		}
+		c.Writer.Header().Del(key)
+		for _, v := range values {
+			c.Writer.Header().Add(key, v)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	tlsclient "github.com/bogdanfinn/tls-client"
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/gin-gonic/gin"
+)
+
+// maxRecentErrors is the number of upstream errors kept for the admin API.
+const maxRecentErrors = 50
+
+const (
+	checkOK      = "ok"
+	checkFailed  = "failed"
+	checkSkipped = "skipped"
+)
+
+// check is the outcome of one readiness check.
+type check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Requests, Failures and ErrorRate describe the recent upstream
+	// requests.
+	Requests  int     `json:"requests,omitempty"`
+	Failures  int     `json:"failures,omitempty"`
+	ErrorRate float64 `json:"error_rate,omitempty"`
+}
+
+// upstreamStats counts the upstream requests and failures of the last
+// window, in one second buckets, and keeps the latest upstream errors.
+type upstreamStats struct {
+	mu      sync.Mutex
+	buckets []upstreamBucket
+	recent  []upstreamFailure
+}
+
+// upstreamFailure is an upstream request that failed or was answered with
+// an error.
+type upstreamFailure struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"request_id"`
+	Route     string        `json:"route"`
+	Status    int           `json:"status,omitempty"`
+	Code      apierror.Code `json:"code"`
+	Message   string        `json:"message"`
+}
+
+type upstreamBucket struct {
+	second   int64
+	requests int
+	failures int
+}
+
+func newUpstreamStats(window time.Duration) *upstreamStats {
+	return &upstreamStats{buckets: make([]upstreamBucket, int(window/time.Second))}
+}
+
+// record counts an upstream request. Transport errors and 5xx answers are
+// failures.
+func (u *upstreamStats) record(status int, err error) {
+	now := time.Now().Unix()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	b := &u.buckets[now%int64(len(u.buckets))]
+	if b.second != now {
+		*b = upstreamBucket{second: now}
+	}
+	b.requests++
+	if err != nil || status >= 500 {
+		b.failures++
+	}
+}
+
+// recordError keeps f among the latest upstream errors.
+func (u *upstreamStats) recordError(f upstreamFailure) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.recent) == maxRecentErrors {
+		copy(u.recent, u.recent[1:])
+		u.recent = u.recent[:maxRecentErrors-1]
+	}
+	u.recent = append(u.recent, f)
+}
+
+// recentErrors returns the latest upstream errors, newest first.
+func (u *upstreamStats) recentErrors() []upstreamFailure {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	errs := make([]upstreamFailure, len(u.recent))
+	for i, f := range u.recent {
+		errs[len(errs)-1-i] = f
+	}
+	return errs
+}
+
+// counts returns the requests and failures of the window.
+func (u *upstreamStats) counts() (requests int, failures int) {
+	oldest := time.Now().Unix() - int64(len(u.buckets))
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, b := range u.buckets {
+		if b.second > oldest {
+			requests += b.requests
+			failures += b.failures
+		}
+	}
+	return requests, failures
+}
+
+// healthz reports that the process is alive.
+func (s *Server) healthz(c *gin.Context) {
+	c.JSON(200, gin.H{"status": checkOK})
+}
+
+// readyz reports whether the proxy can serve requests, with the outcome of
+// every check.
+func (s *Server) readyz(c *gin.Context) {
+	checks := map[string]check{
+		"client":   s.checkClient(),
+		"proxy":    s.checkProxy(),
+		"upstream": s.checkUpstream(),
+	}
+	status, code := "ready", 200
+	for _, ch := range checks {
+		if ch.Status == checkFailed {
+			status, code = "unavailable", 503
+		}
+	}
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
+
+// checkClient verifies that an outbound client can be built with the current
+// settings.
+func (s *Server) checkClient() check {
+	cfg := s.current().cfg
+	client, err := tlsclient.NewHttpClient(tlsclient.NewNoopLogger(), clientOptions(cfg, tlsclient.NewCookieJar())...)
+	if err == nil && cfg.Client.Proxy != "" {
+		err = client.SetProxy(cfg.Client.Proxy)
+	}
+	if err != nil {
+		return check{Status: checkFailed, Error: err.Error()}
+	}
+	return check{Status: checkOK}
+}
+
+// checkProxy verifies that the outbound proxy accepts connections.
+func (s *Server) checkProxy() check {
+	cfg := s.current().cfg
+	if cfg.Client.Proxy == "" {
+		return check{Status: checkSkipped}
+	}
+	u, err := url.Parse(cfg.Client.Proxy)
+	if err != nil {
+		return check{Status: checkFailed, Error: err.Error()}
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultProxyPort(u.Scheme))
+	}
+	conn, err := net.DialTimeout("tcp", addr, time.Duration(cfg.Health.ProxyTimeout))
+	if err != nil {
+		return check{Status: checkFailed, Error: err.Error()}
+	}
+	conn.Close()
+	return check{Status: checkOK}
+}
+
+// checkUpstream verifies that the recent upstream error rate is below the
+// configured maximum.
+func (s *Server) checkUpstream() check {
+	cfg := s.current().cfg
+	requests, failures := s.upstreamStats.counts()
+	ch := check{Status: checkOK, Requests: requests, Failures: failures}
+	if requests == 0 {
+		return ch
+	}
+	ch.ErrorRate = float64(failures) / float64(requests)
+	if requests >= cfg.Health.MinRequests && ch.ErrorRate > cfg.Health.MaxErrorRate {
+		ch.Status = checkFailed
+		ch.Error = "upstream error rate above maximum"
+	}
+	return ch
+}
+
+func defaultProxyPort(scheme string) string {
+	switch scheme {
+	case "https":
+		return "443"
+	case "socks5", "socks5h":
+		return "1080"
+	default:
+		return "80"
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/flyingpot/chatgpt-proxy/logging"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// contextRequestID holds the id of the request.
+	contextRequestID = "request_id"
+	// contextLogger holds the logger of the request.
+	contextLogger = "logger"
+	// maxRequestIDLength bounds the caller supplied request ids accepted.
+	maxRequestIDLength = 128
+)
+
+// requestLogging assigns every request an id, taken from X-Request-ID when
+// the caller sends a usable one, echoes it in the response and writes an
+// access log line once the request is done.
+func (s *Server) requestLogging() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = randomHex(16)
+		}
+		logger := s.logger.With(slog.String("request_id", id)).With(traceAttrs(c.Request.Context())...)
+		c.Set(contextRequestID, id)
+		c.Set(contextLogger, logger)
+		c.Header(requestIDHeader, id)
+
+		c.Next()
+
+		level := slog.LevelInfo
+		switch status := c.Writer.Status(); {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", c.Writer.Status()),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if size := c.Writer.Size(); size > 0 {
+			attrs = append(attrs, slog.Int("bytes", size))
+		}
+		if name := c.GetString(contextKeyName); name != "" {
+			attrs = append(attrs, slog.String("key", name))
+		}
+		if logger.Enabled(c, slog.LevelDebug) {
+			attrs = append(attrs, logging.Headers("headers", c.Request.Header))
+		}
+		logger.LogAttrs(c, level, "request", attrs...)
+	}
+}
+
+// recoverPanics answers a request whose handler panicked with an
+// internal_error and logs the panic with its stack.
+func (s *Server) recoverPanics() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(nil, func(c *gin.Context, err any) {
+		requestLogger(c).Error("panic", slog.Any("error", err), slog.String("stack", string(debug.Stack())))
+		e := apierror.New(apierror.CodeInternal, 500, "internal server error")
+		c.AbortWithStatusJSON(e.Status, e.Response())
+	})
+}
+
+// requestLogger returns the logger of the request, which tags every line
+// with the request id.
+func requestLogger(c *gin.Context) *slog.Logger {
+	if v, ok := c.Get(contextLogger); ok {
+		return v.(*slog.Logger)
+	}
+	return slog.Default()
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
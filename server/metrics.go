@@ -0,0 +1,186 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "chatgpt_proxy"
+
+// metrics holds the Prometheus collectors of a Server. Each Server has its own
+// registry, so several of them can live in one process.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests         *prometheus.CounterVec
+	responseBytes    *prometheus.CounterVec
+	upstreamDuration *prometheus.HistogramVec
+	firstByte        prometheus.Histogram
+	activeStreams    prometheus.Gauge
+	arkoseDuration   prometheus.Histogram
+	arkoseFailures   prometheus.Counter
+	// abortedGenerations counts conversations cut off before the upstream
+	// finished, by reason.
+	abortedGenerations *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Requests handled, by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "response_bytes_total",
+			Help:      "Bytes of response bodies sent to callers, by route.",
+		}, []string{"route"}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_request_duration_seconds",
+			Help:      "Time until the upstream answered with response headers, by upstream route and status.",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"route", "status"}),
+		firstByte: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "stream_first_byte_seconds",
+			Help:      "Time from receiving a conversation request to sending the first byte of its answer.",
+			Buckets:   []float64{0.25, 0.5, 1, 2, 4, 8, 15, 30, 60},
+		}),
+		activeStreams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_streams",
+			Help:      "Conversation streams in flight.",
+		}),
+		arkoseDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "arkose_token_duration_seconds",
+			Help:      "Time spent fetching arkose tokens.",
+			Buckets:   []float64{0.25, 0.5, 1, 2, 4, 8, 15},
+		}),
+		arkoseFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "arkose_token_failures_total",
+			Help:      "Arkose token fetches that failed.",
+		}),
+		abortedGenerations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "aborted_generations_total",
+			Help:      "Conversations whose upstream request was aborted, by reason: client_disconnect or cancelled by the proxy.",
+		}, []string{"reason"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.responseBytes,
+		m.upstreamDuration,
+		m.firstByte,
+		m.activeStreams,
+		m.arkoseDuration,
+		m.arkoseFailures,
+		m.abortedGenerations,
+	)
+	return m
+}
+
+// handler serves the registry in the Prometheus exposition format.
+func (m *metrics) handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// observeRequests counts every request and the bytes sent for it, and times
+// the first byte of conversation answers.
+func (m *metrics) observeRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isConversation(c) {
+			c.Writer = &firstByteWriter{ResponseWriter: c.Writer, start: time.Now(), observe: m.firstByte}
+		}
+		c.Next()
+
+		route := metricRoute(c)
+		m.requests.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+		if size := c.Writer.Size(); size > 0 {
+			m.responseBytes.WithLabelValues(route).Add(float64(size))
+		}
+	}
+}
+
+// observeUpstream records the latency of an upstream request sent at start.
+func (m *metrics) observeUpstream(route string, start time.Time, response *http.Response) {
+	status := "error"
+	if response != nil {
+		status = strconv.Itoa(response.StatusCode)
+	}
+	m.upstreamDuration.WithLabelValues(routeLabel(route), status).Observe(time.Since(start).Seconds())
+}
+
+// observeArkose records an arkose token fetch started at start.
+func (m *metrics) observeArkose(start time.Time, err error) {
+	m.arkoseDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.arkoseFailures.Inc()
+	}
+}
+
+// firstByteWriter observes the time until the first successful body write.
+// SSE comments, like the queue position sent while a stream waits for its
+// turn, are not part of the answer and do not count.
+type firstByteWriter struct {
+	gin.ResponseWriter
+	start   time.Time
+	observe prometheus.Observer
+	written bool
+}
+
+func (w *firstByteWriter) Write(data []byte) (int, error) {
+	if len(data) == 0 || data[0] != ':' {
+		w.observeFirstByte()
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *firstByteWriter) WriteString(s string) (int, error) {
+	if !strings.HasPrefix(s, ":") {
+		w.observeFirstByte()
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *firstByteWriter) observeFirstByte() {
+	if w.written {
+		return
+	}
+	w.written = true
+	if w.Status() < 300 {
+		w.observe.Observe(time.Since(w.start).Seconds())
+	}
+}
+
+// metricRoute returns the route label of a request.
+func metricRoute(c *gin.Context) string {
+	switch c.FullPath() {
+	case "":
+		return "unmatched"
+	case "/api/*path":
+		return "/api" + routeLabel(c.Param("path"))
+	default:
+		return c.FullPath()
+	}
+}
+
+// routeLabel reduces an upstream path to its first segment, which bounds the
+// cardinality of route labels: /conversation/<id> becomes /conversation.
+func routeLabel(path string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return "/" + segment
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	queuePositionHeader = "X-Queue-Position"
+
+	// queueEventsHeader and queueEventsQuery ask for the queue position to
+	// be streamed while waiting.
+	queueEventsHeader = "X-Queue-Events"
+	queueEventsQuery  = "queue_events"
+)
+
+// queuePollInterval is how often a waiting stream checks its place in the
+// queue.
+const queuePollInterval = time.Second
+
+// tokenQueue serializes the conversations of one access token.
+type tokenQueue struct {
+	busy    bool
+	waiters []chan struct{}
+}
+
+// conversationQueue runs at most one conversation per access token at a
+// time and queues the others in FIFO order.
+type conversationQueue struct {
+	maxLength int
+	timeout   time.Duration
+
+	mu     sync.Mutex
+	queues map[[sha256.Size]byte]*tokenQueue
+}
+
+func newConversationQueue(maxLength int, timeout time.Duration) *conversationQueue {
+	return &conversationQueue{
+		maxLength: maxLength,
+		timeout:   timeout,
+		queues:    make(map[[sha256.Size]byte]*tokenQueue),
+	}
+}
+
+// enqueue takes the turn of token, or a place in its queue. It returns the
+// position in the queue, 0 if the turn was free, and a channel closed when
+// the turn is handed over (nil if it is already held). ok is false if the
+// queue is full.
+func (q *conversationQueue) enqueue(id [sha256.Size]byte) (position int, turn chan struct{}, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tq, exists := q.queues[id]
+	if !exists {
+		tq = &tokenQueue{}
+		q.queues[id] = tq
+	}
+	if !tq.busy {
+		tq.busy = true
+		return 0, nil, true
+	}
+	if len(tq.waiters) >= q.maxLength {
+		return 0, nil, false
+	}
+	turn = make(chan struct{})
+	tq.waiters = append(tq.waiters, turn)
+	return len(tq.waiters), turn, true
+}
+
+// leave gives up a place in the queue. It reports false if the turn was
+// handed over in the meantime, in which case the caller holds it.
+func (q *conversationQueue) leave(id [sha256.Size]byte, turn chan struct{}) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tq := q.queues[id]
+	for i, w := range tq.waiters {
+		if w == turn {
+			tq.waiters = append(tq.waiters[:i], tq.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// release ends the turn of token, handing it to the next waiter.
+func (q *conversationQueue) release(id [sha256.Size]byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tq := q.queues[id]
+	if len(tq.waiters) > 0 {
+		next := tq.waiters[0]
+		tq.waiters = tq.waiters[1:]
+		close(next)
+		return
+	}
+	delete(q.queues, id)
+}
+
+// position returns the place of turn in the queue of id, 0 once the turn
+// was handed over.
+func (q *conversationQueue) position(id [sha256.Size]byte, turn chan struct{}) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tq, ok := q.queues[id]
+	if !ok {
+		return 0
+	}
+	for i, w := range tq.waiters {
+		if w == turn {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// queueConversations serializes the conversations sent with the same access
+// token. The caller's initial place in the queue is reported in
+// X-Queue-Position.
+//
+// Waiting callers answered with an event stream can ask for queue events.
+// They then get the headers right away, followed by a ": queue position N"
+// comment whenever their place changes. As the 200 is already sent, later
+// errors reach them as an error event. Their stream slot is taken before the
+// headers are sent, so that too_many_streams is still answered as a 429.
+func (s *Server) queueConversations() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.queue == nil || !isConversation(c) {
+			c.Next()
+			return
+		}
+
+		id := sha256.Sum256([]byte(accessToken(c)))
+		position, turn, ok := s.queue.enqueue(id)
+		if !ok {
+			abortWithError(c, apierror.QueueFull())
+			return
+		}
+		c.Header(queuePositionHeader, strconv.Itoa(position))
+
+		// The slot taken for queue events is handed on to limitStreams,
+		// which releases it; this only covers an aborted wait.
+		defer s.releaseStream(c)
+		if turn != nil && !s.waitTurn(c, id, position, turn) {
+			return
+		}
+		defer s.queue.release(id)
+		c.Next()
+	}
+}
+
+// waitTurn waits for the turn of id to be handed to turn. It reports false,
+// with the request aborted, if the caller gave up or the wait timed out.
+func (s *Server) waitTurn(c *gin.Context, id [sha256.Size]byte, position int, turn chan struct{}) bool {
+	timer := time.NewTimer(s.queue.timeout)
+	defer timer.Stop()
+
+	var poll <-chan time.Time
+	if wantsQueueEvents(c) && streamsResponse(c) && s.acquireStream(c) {
+		c.Header("Content-Type", "text/event-stream; charset=utf-8")
+		c.Status(200)
+		writeQueuePosition(c, position)
+		ticker := time.NewTicker(queuePollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-turn:
+			return true
+		case <-poll:
+			if p := s.queue.position(id, turn); p > 0 && p != position {
+				position = p
+				writeQueuePosition(c, position)
+			}
+		case <-timer.C:
+			if s.queue.leave(id, turn) {
+				abortWithError(c, apierror.QueueTimeout(s.queue.timeout))
+				return false
+			}
+			return true
+		case <-c.Request.Context().Done():
+			if !s.queue.leave(id, turn) {
+				s.queue.release(id)
+			}
+			c.Abort()
+			return false
+		}
+	}
+}
+
+func writeQueuePosition(c *gin.Context, position int) {
+	fmt.Fprintf(c.Writer, ": queue position %d\n\n", position)
+	c.Writer.Flush()
+}
+
+// wantsQueueEvents reports whether the caller asked for queue events through
+// the X-Queue-Events header or the queue_events query parameter.
+func wantsQueueEvents(c *gin.Context) bool {
+	v := c.GetHeader(queueEventsHeader)
+	if v == "" {
+		v = c.Query(queueEventsQuery)
+	}
+	events, _ := strconv.ParseBool(v)
+	return events
+}
+
+// streamsResponse reports whether the conversation is answered with an event
+// stream, which can carry the queue position before the turn comes. The
+// request body is read into memory, as HTTP/1 request bodies can no longer
+// be read once the response has started.
+func streamsResponse(c *gin.Context) bool {
+	body, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	if c.FullPath() != "/v1/chat/completions" {
+		return streamMode(c) != streamModeAggregate
+	}
+	var request struct {
+		Stream bool `json:"stream"`
+	}
+	return json.Unmarshal(body, &request) == nil && request.Stream
+}
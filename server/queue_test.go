@@ -0,0 +1,437 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/flyingpot/chatgpt-proxy/config"
+)
+
+// gate reports the conversations reaching holdingUpstream and holds those
+// for the "hold" model until it is opened.
+type gate struct {
+	started chan string
+	release chan struct{}
+	once    sync.Once
+}
+
+func newGate(t *testing.T) *gate {
+	g := &gate{started: make(chan string, 16), release: make(chan struct{})}
+	t.Cleanup(g.open)
+	return g
+}
+
+func (g *gate) hold(r *nethttp.Request, model string) {
+	g.started <- model
+	if model != "hold" {
+		return
+	}
+	select {
+	case <-g.release:
+	case <-r.Context().Done():
+	}
+}
+
+func (g *gate) open() {
+	g.once.Do(func() { close(g.release) })
+}
+
+// next returns the model of the next conversation reaching the upstream.
+func (g *gate) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case model := <-g.started:
+		return model
+	case <-time.After(5 * time.Second):
+		t.Fatal("no conversation reached the upstream")
+		return ""
+	}
+}
+
+// start serves a conversation in the background.
+func start(ctx context.Context, s *Server, target string, body string, header map[string]string) <-chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		done <- serveContext(ctx, s, "POST", target, body, header)
+	}()
+	return done
+}
+
+func receive(t *testing.T, done <-chan *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	t.Helper()
+	select {
+	case recorder := <-done:
+		return recorder
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not finish")
+		return nil
+	}
+}
+
+// waitFor polls cond until it holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waiting returns the number of queued conversations, and idle whether no
+// token holds a turn.
+func waiting(q *conversationQueue) (n int, idle bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, tq := range q.queues {
+		n += len(tq.waiters)
+	}
+	return n, len(q.queues) == 0
+}
+
+func waitQueued(t *testing.T, s *Server, want int) {
+	t.Helper()
+	waitFor(t, "queued conversations", func() bool {
+		n, _ := waiting(s.queue)
+		return n == want
+	})
+}
+
+func assertIdle(t *testing.T, s *Server) {
+	t.Helper()
+	if n, idle := waiting(s.queue); n != 0 || !idle {
+		t.Errorf("queue holds %d waiters and idle = %v after all requests finished", n, idle)
+	}
+}
+
+func enableQueue(maxLength int, timeout time.Duration) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.Queue.Enabled = true
+		cfg.Queue.MaxLength = maxLength
+		cfg.Queue.WaitTimeout = config.Duration(timeout)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	g := newGate(t)
+	s := newTestServer(t, holdingUpstream(t, g.hold), enableQueue(10, time.Minute))
+	ctx := context.Background()
+
+	first := start(ctx, s, "/api/conversation", conversationBody("hold"), nil)
+	if model := g.next(t); model != "hold" {
+		t.Fatalf("upstream got %q first", model)
+	}
+	var waiters []<-chan *httptest.ResponseRecorder
+	models := []string{"second", "third", "fourth"}
+	for i, model := range models {
+		waiters = append(waiters, start(ctx, s, "/api/conversation", conversationBody(model), nil))
+		waitQueued(t, s, i+1)
+	}
+	g.open()
+
+	for i, done := range append([]<-chan *httptest.ResponseRecorder{first}, waiters...) {
+		recorder := receive(t, done)
+		if recorder.Code != 200 {
+			t.Errorf("request %d: status = %d, want 200", i, recorder.Code)
+		}
+		if got, want := recorder.Header().Get(queuePositionHeader), string(rune('0'+i)); got != want {
+			t.Errorf("request %d: %s = %q, want %q", i, queuePositionHeader, got, want)
+		}
+	}
+	for _, want := range models {
+		if got := g.next(t); got != want {
+			t.Errorf("upstream got %q, want %q", got, want)
+		}
+	}
+	assertIdle(t, s)
+}
+
+func TestQueueRejections(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxLength  int
+		timeout    time.Duration
+		waiters    int
+		wantStatus int
+		wantCode   apierror.Code
+	}{
+		{
+			name:       "queue full",
+			maxLength:  1,
+			timeout:    time.Minute,
+			waiters:    1,
+			wantStatus: 429,
+			wantCode:   apierror.CodeQueueFull,
+		},
+		{
+			name:       "wait timeout",
+			maxLength:  10,
+			timeout:    50 * time.Millisecond,
+			wantStatus: 503,
+			wantCode:   apierror.CodeQueueTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGate(t)
+			s := newTestServer(t, holdingUpstream(t, g.hold), enableQueue(tt.maxLength, tt.timeout))
+			ctx := context.Background()
+
+			first := start(ctx, s, "/api/conversation", conversationBody("hold"), nil)
+			g.next(t)
+			var waiters []<-chan *httptest.ResponseRecorder
+			for i := 0; i < tt.waiters; i++ {
+				waiters = append(waiters, start(ctx, s, "/api/conversation", conversationBody("gpt-3.5"), nil))
+				waitQueued(t, s, i+1)
+			}
+
+			recorder := serve(s, "POST", "/api/conversation", conversationBody("gpt-3.5"), nil)
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if e := decodeError(t, recorder); e.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", e.Code, tt.wantCode)
+			}
+			if n, _ := waiting(s.queue); n != tt.waiters {
+				t.Errorf("%d waiters after the rejection, want %d", n, tt.waiters)
+			}
+
+			g.open()
+			for _, done := range append(waiters, first) {
+				if recorder := receive(t, done); recorder.Code != 200 {
+					t.Errorf("queued request: status = %d, want 200", recorder.Code)
+				}
+			}
+			assertIdle(t, s)
+		})
+	}
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	g := newGate(t)
+	s := newTestServer(t, holdingUpstream(t, g.hold), enableQueue(10, time.Minute))
+
+	first := start(context.Background(), s, "/api/conversation", conversationBody("hold"), nil)
+	g.next(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	gone := start(ctx, s, "/api/conversation", conversationBody("gone"), nil)
+	waitQueued(t, s, 1)
+	third := start(context.Background(), s, "/api/conversation", conversationBody("third"), nil)
+	waitQueued(t, s, 2)
+
+	cancel()
+	receive(t, gone)
+	waitQueued(t, s, 1)
+
+	g.open()
+	for _, done := range []<-chan *httptest.ResponseRecorder{first, third} {
+		if recorder := receive(t, done); recorder.Code != 200 {
+			t.Errorf("status = %d, want 200", recorder.Code)
+		}
+	}
+	if got := g.next(t); got != "third" {
+		t.Errorf("upstream got %q, want the request queued after the one that left", got)
+	}
+	assertIdle(t, s)
+}
+
+func TestQueueEvents(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		body        string
+		header      map[string]string
+		maxStreams  int
+		wantStatus  int
+		wantComment bool
+		wantBody    string
+	}{
+		{
+			name:        "opted in",
+			target:      "/api/conversation",
+			body:        conversationBody("gpt-3.5"),
+			header:      map[string]string{queueEventsHeader: "1"},
+			wantStatus:  200,
+			wantComment: true,
+			wantBody:    "data: [DONE]",
+		},
+		{
+			name:        "opted in through the query",
+			target:      "/api/conversation?queue_events=true",
+			body:        conversationBody("gpt-3.5"),
+			wantStatus:  200,
+			wantComment: true,
+			wantBody:    "data: [DONE]",
+		},
+		{
+			name:        "upstream error after the wait",
+			target:      "/api/conversation",
+			body:        conversationBody("fail"),
+			header:      map[string]string{queueEventsHeader: "1"},
+			wantStatus:  200,
+			wantComment: true,
+			wantBody:    `"code":"` + string(apierror.CodeUpstreamRateLimited) + `"`,
+		},
+		{
+			name:       "not opted in",
+			target:     "/api/conversation",
+			body:       conversationBody("fail"),
+			wantStatus: 429,
+			wantBody:   `"code":"` + string(apierror.CodeUpstreamRateLimited) + `"`,
+		},
+		{
+			name:       "aggregate mode",
+			target:     "/api/conversation",
+			body:       conversationBody("fail"),
+			header:     map[string]string{queueEventsHeader: "1", streamModeHeader: streamModeAggregate},
+			wantStatus: 429,
+			wantBody:   `"code":"` + string(apierror.CodeUpstreamRateLimited) + `"`,
+		},
+		{
+			name:       "chat completion without stream",
+			target:     "/v1/chat/completions",
+			body:       chatCompletionBody("fail", false),
+			header:     map[string]string{queueEventsHeader: "1"},
+			wantStatus: 429,
+			wantBody:   `"code":"` + string(apierror.CodeUpstreamRateLimited) + `"`,
+		},
+		{
+			name:        "chat completion stream",
+			target:      "/v1/chat/completions",
+			body:        chatCompletionBody("gpt-3.5", true),
+			header:      map[string]string{queueEventsHeader: "1"},
+			wantStatus:  200,
+			wantComment: true,
+			wantBody:    "data: [DONE]",
+		},
+		{
+			name:       "no free stream slot",
+			target:     "/api/conversation",
+			body:       conversationBody("gpt-3.5"),
+			header:     map[string]string{queueEventsHeader: "1"},
+			maxStreams: 1,
+			wantStatus: 200,
+			wantBody:   "data: [DONE]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGate(t)
+			s := newTestServer(t, holdingUpstream(t, g.hold), enableQueue(10, time.Minute), func(cfg *config.Config) {
+				cfg.Limits.MaxStreams = tt.maxStreams
+			})
+			ctx := context.Background()
+
+			first := start(ctx, s, "/api/conversation", conversationBody("hold"), nil)
+			g.next(t)
+			waiter := start(ctx, s, tt.target, tt.body, tt.header)
+			waitQueued(t, s, 1)
+			g.open()
+
+			receive(t, first)
+			recorder := receive(t, waiter)
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			body := recorder.Body.String()
+			if got := strings.HasPrefix(body, ": queue position 1\n\n"); got != tt.wantComment {
+				t.Errorf("body starts with the queue position = %v, want %v; body:\n%s", got, tt.wantComment, body)
+			}
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("body does not contain %q:\n%s", tt.wantBody, body)
+			}
+			assertIdle(t, s)
+			if active := s.current().streams.active; active != 0 {
+				t.Errorf("%d stream slots held after all requests finished", active)
+			}
+		})
+	}
+}
+
+// TestQueueLeaveRace gives up waits while turns are handed over, and checks
+// that no turn is held twice or lost.
+func TestQueueLeaveRace(t *testing.T) {
+	q := newConversationQueue(100, time.Minute)
+	id := sha256.Sum256([]byte("token"))
+
+	var wg sync.WaitGroup
+	var holders, ran, left atomic.Int32
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, turn, ok := q.enqueue(id)
+			if !ok {
+				t.Error("queue full")
+				return
+			}
+			if turn != nil {
+				if i%2 == 0 {
+					time.Sleep(time.Duration(i%5) * 100 * time.Microsecond)
+					if q.leave(id, turn) {
+						left.Add(1)
+						return
+					}
+					// The turn was handed over before leaving: it is ours.
+				} else {
+					<-turn
+				}
+			}
+			if holders.Add(1) != 1 {
+				t.Error("turn held twice")
+			}
+			ran.Add(1)
+			time.Sleep(50 * time.Microsecond)
+			holders.Add(-1)
+			q.release(id)
+		}(i)
+	}
+	wg.Wait()
+
+	if got := ran.Load() + left.Load(); got != 100 {
+		t.Errorf("%d requests ran and %d left, want 100 in total", ran.Load(), left.Load())
+	}
+	if n, idle := waiting(q); n != 0 || !idle {
+		t.Errorf("queue holds %d waiters and idle = %v at the end", n, idle)
+	}
+}
+
+func TestQueueLeaveAfterHandOver(t *testing.T) {
+	q := newConversationQueue(10, time.Minute)
+	id := sha256.Sum256([]byte("token"))
+
+	if position, turn, _ := q.enqueue(id); position != 0 || turn != nil {
+		t.Fatalf("enqueue() on a free turn = %d, %v", position, turn)
+	}
+	position, turn, _ := q.enqueue(id)
+	if position != 1 || turn == nil {
+		t.Fatalf("enqueue() on a busy turn = %d, %v", position, turn)
+	}
+
+	q.release(id)
+	select {
+	case <-turn:
+	default:
+		t.Fatal("release() did not hand the turn over")
+	}
+	if q.leave(id, turn) {
+		t.Fatal("leave() after the hand-over reported the place given up")
+	}
+	if n, idle := waiting(q); n != 0 || idle {
+		t.Errorf("queue holds %d waiters and idle = %v while the turn is held", n, idle)
+	}
+	q.release(id)
+	if _, idle := waiting(q); !idle {
+		t.Error("queue not idle after the last release")
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/flyingpot/chatgpt-proxy/config"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// contextStreamSlot is set while the request holds a stream slot.
+const contextStreamSlot = "stream_slot"
+
+const (
+	// limiterIdleTimeout is how long an unused limiter is kept.
+	limiterIdleTimeout = 10 * time.Minute
+	limiterSweepPeriod = time.Minute
+)
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// limiterSet holds one token bucket per identity (proxy key or client IP).
+type limiterSet struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	limiters  map[string]*limiterEntry
+	lastSweep time.Time
+}
+
+func newLimiterSet(l config.RateLimit) *limiterSet {
+	if l.RequestsPerMinute <= 0 {
+		return nil
+	}
+	burst := l.Burst
+	if burst <= 0 {
+		burst = int(math.Ceil(l.RequestsPerMinute))
+	}
+	return &limiterSet{
+		limit:    rate.Limit(l.RequestsPerMinute / 60),
+		burst:    burst,
+		limiters: make(map[string]*limiterEntry),
+	}
+}
+
+// reserve takes a token for id and returns how long the caller has to wait
+// for it; in that case the token is given back.
+func (s *limiterSet) reserve(id string) time.Duration {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > limiterSweepPeriod {
+		for k, e := range s.limiters {
+			if now.Sub(e.lastSeen) > limiterIdleTimeout {
+				delete(s.limiters, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	e, ok := s.limiters[id]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(s.limit, s.burst)}
+		s.limiters[id] = e
+	}
+	e.lastSeen = now
+
+	r := e.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// streamLimiter caps the number of in-flight conversation streams, overall
+// and per proxy key.
+type streamLimiter struct {
+	max       int
+	maxPerKey int
+
+	mu     sync.Mutex
+	active int
+	perKey map[string]int
+}
+
+func newStreamLimiter(l config.Limits) *streamLimiter {
+	return &streamLimiter{
+		max:       l.MaxStreams,
+		maxPerKey: l.MaxStreamsPerKey,
+		perKey:    make(map[string]int),
+	}
+}
+
+func (s *streamLimiter) acquire(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.max > 0 && s.active >= s.max {
+		return false
+	}
+	if key != "" && s.maxPerKey > 0 && s.perKey[key] >= s.maxPerKey {
+		return false
+	}
+	s.active++
+	if key != "" {
+		s.perKey[key]++
+	}
+	return true
+}
+
+func (s *streamLimiter) release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if key != "" {
+		if s.perKey[key]--; s.perKey[key] <= 0 {
+			delete(s.perKey, key)
+		}
+	}
+}
+
+// limitIP applies the per client IP rate limit.
+func (s *Server) limitIP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limits := s.requestState(c).ipLimits; limits != nil {
+			if delay := limits.reserve(c.ClientIP()); delay > 0 {
+				abortWithError(c, apierror.RateLimited("too many requests from this address", delay))
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// limitKey applies the per proxy key rate limit. It runs after
+// authenticate and does nothing without proxy keys.
+func (s *Server) limitKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limits := s.requestState(c).keyLimits
+		if name := c.GetString(contextKeyName); name != "" && limits != nil {
+			if delay := limits.reserve(name); delay > 0 {
+				abortWithError(c, apierror.RateLimited("too many requests for this API key", delay))
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// limitStreams caps concurrent conversation streams.
+func (s *Server) limitStreams() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isConversation(c) {
+			c.Next()
+			return
+		}
+		if !s.acquireStream(c) {
+			abortWithError(c, apierror.TooManyStreams())
+			return
+		}
+		defer s.releaseStream(c)
+		c.Next()
+	}
+}
+
+// acquireStream takes a stream slot for the request, unless it holds one
+// already, and reports false if none is free.
+func (s *Server) acquireStream(c *gin.Context) bool {
+	if c.GetBool(contextStreamSlot) {
+		return true
+	}
+	if !s.requestState(c).streams.acquire(c.GetString(contextKeyName)) {
+		return false
+	}
+	c.Set(contextStreamSlot, true)
+	s.metrics.activeStreams.Inc()
+	return true
+}
+
+// releaseStream gives back the stream slot of the request, if it holds one.
+func (s *Server) releaseStream(c *gin.Context) {
+	if !c.GetBool(contextStreamSlot) {
+		return
+	}
+	c.Set(contextStreamSlot, false)
+	s.requestState(c).streams.release(c.GetString(contextKeyName))
+	s.metrics.activeStreams.Dec()
+}
+
+// isConversation reports whether the request starts a conversation stream.
+func isConversation(c *gin.Context) bool {
+	if c.Request.Method != "POST" {
+		return false
+	}
+	return c.FullPath() == "/v1/chat/completions" || (c.FullPath() == "/api/*path" && c.Param("path") == "/conversation")
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/flyingpot/chatgpt-proxy/config"
+)
+
+var testKeys = []config.APIKey{
+	{Name: "alice", Key: "key-alice", AccessToken: "token-alice"},
+	{Name: "bob", Key: "key-bob", AccessToken: "token-bob"},
+}
+
+func TestRateLimits(t *testing.T) {
+	type request struct {
+		key            string
+		remoteAddr     string
+		forwardedFor   string
+		wantStatus     int
+		wantRetryAfter string
+	}
+	tests := []struct {
+		name      string
+		configure func(cfg *config.Config)
+		requests  []request
+	}{
+		{
+			name: "per key",
+			configure: func(cfg *config.Config) {
+				cfg.Auth.Keys = testKeys
+				cfg.Limits.PerKey = config.RateLimit{RequestsPerMinute: 1, Burst: 1}
+			},
+			requests: []request{
+				{key: "key-alice", wantStatus: 200},
+				{key: "key-alice", wantStatus: 429, wantRetryAfter: "60"},
+				{key: "key-bob", wantStatus: 200},
+			},
+		},
+		{
+			name: "per key burst",
+			configure: func(cfg *config.Config) {
+				cfg.Auth.Keys = testKeys
+				cfg.Limits.PerKey = config.RateLimit{RequestsPerMinute: 60, Burst: 2}
+			},
+			requests: []request{
+				{key: "key-alice", wantStatus: 200},
+				{key: "key-alice", wantStatus: 200},
+				{key: "key-alice", wantStatus: 429, wantRetryAfter: "1"},
+			},
+		},
+		{
+			name: "per IP",
+			configure: func(cfg *config.Config) {
+				cfg.Limits.PerIP = config.RateLimit{RequestsPerMinute: 2, Burst: 1}
+			},
+			requests: []request{
+				{remoteAddr: "192.0.2.1:1234", wantStatus: 200},
+				{remoteAddr: "192.0.2.1:5678", wantStatus: 429, wantRetryAfter: "30"},
+				{remoteAddr: "192.0.2.2:1234", wantStatus: 200},
+			},
+		},
+		{
+			name: "forwarded address of an untrusted peer",
+			configure: func(cfg *config.Config) {
+				cfg.Limits.PerIP = config.RateLimit{RequestsPerMinute: 1, Burst: 1}
+			},
+			requests: []request{
+				{remoteAddr: "192.0.2.1:1234", forwardedFor: "198.51.100.1", wantStatus: 200},
+				{remoteAddr: "192.0.2.1:1234", forwardedFor: "198.51.100.2", wantStatus: 429, wantRetryAfter: "60"},
+			},
+		},
+		{
+			name: "forwarded address of a trusted proxy",
+			configure: func(cfg *config.Config) {
+				cfg.Server.TrustedProxies = []string{"192.0.2.0/24"}
+				cfg.Limits.PerIP = config.RateLimit{RequestsPerMinute: 1, Burst: 1}
+			},
+			requests: []request{
+				{remoteAddr: "192.0.2.1:1234", forwardedFor: "198.51.100.1", wantStatus: 200},
+				{remoteAddr: "192.0.2.1:1234", forwardedFor: "198.51.100.2", wantStatus: 200},
+				{remoteAddr: "192.0.2.2:1234", forwardedFor: "198.51.100.1", wantStatus: 429, wantRetryAfter: "60"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, fakeUpstream(t), tt.configure)
+			for i, r := range tt.requests {
+				request := httptest.NewRequest("GET", "/api/models", nil)
+				if r.key != "" {
+					request.Header.Set("Authorization", "Bearer "+r.key)
+				} else {
+					request.Header.Set("Authorization", "Bearer token")
+				}
+				if r.remoteAddr != "" {
+					request.RemoteAddr = r.remoteAddr
+				}
+				if r.forwardedFor != "" {
+					request.Header.Set("X-Forwarded-For", r.forwardedFor)
+				}
+				recorder := httptest.NewRecorder()
+				s.Handler().ServeHTTP(recorder, request)
+
+				if recorder.Code != r.wantStatus {
+					t.Fatalf("request %d: status = %d, want %d", i, recorder.Code, r.wantStatus)
+				}
+				if got := recorder.Header().Get("Retry-After"); got != r.wantRetryAfter {
+					t.Errorf("request %d: Retry-After = %q, want %q", i, got, r.wantRetryAfter)
+				}
+				if r.wantStatus == 429 {
+					if e := decodeError(t, recorder); e.Code != apierror.CodeRateLimited {
+						t.Errorf("request %d: code = %q, want %q", i, e.Code, apierror.CodeRateLimited)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		limits     config.Limits
+		key        string
+		wantStatus int
+	}{
+		{name: "overall cap", limits: config.Limits{MaxStreams: 1}, key: "key-bob", wantStatus: 429},
+		{name: "per key cap", limits: config.Limits{MaxStreamsPerKey: 1}, key: "key-alice", wantStatus: 429},
+		{name: "per key cap of another key", limits: config.Limits{MaxStreamsPerKey: 1}, key: "key-bob", wantStatus: 200},
+		{name: "under the caps", limits: config.Limits{MaxStreams: 2, MaxStreamsPerKey: 2}, key: "key-alice", wantStatus: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGate(t)
+			s := newTestServer(t, holdingUpstream(t, g.hold), func(cfg *config.Config) {
+				cfg.Auth.Keys = testKeys
+				cfg.Limits = tt.limits
+			})
+			ctx := context.Background()
+
+			first := start(ctx, s, "/api/conversation", conversationBody("hold"), map[string]string{"Authorization": "Bearer key-alice"})
+			g.next(t)
+			recorder := serve(s, "POST", "/api/conversation", conversationBody("gpt-3.5"), map[string]string{"Authorization": "Bearer " + tt.key})
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == 429 {
+				if e := decodeError(t, recorder); e.Code != apierror.CodeTooManyStreams {
+					t.Errorf("code = %q, want %q", e.Code, apierror.CodeTooManyStreams)
+				}
+			} else if !strings.Contains(recorder.Body.String(), "data: [DONE]") {
+				t.Errorf("body = %q, want a complete stream", recorder.Body)
+			}
+
+			g.open()
+			receive(t, first)
+			if recorder := serve(s, "POST", "/api/conversation", conversationBody("gpt-3.5"), map[string]string{"Authorization": "Bearer " + tt.key}); recorder.Code != 200 {
+				t.Errorf("status after the first stream ended = %d, want 200", recorder.Code)
+			}
+			streams := s.current().streams
+			streams.mu.Lock()
+			defer streams.mu.Unlock()
+			if streams.active != 0 || len(streams.perKey) != 0 {
+				t.Errorf("%d streams and %v per key active after all requests finished", streams.active, streams.perKey)
+			}
+		})
+	}
+}
+
+func TestLimiterSetGivesBackDeniedTokens(t *testing.T) {
+	limits := newLimiterSet(config.RateLimit{RequestsPerMinute: 60, Burst: 1})
+	if delay := limits.reserve("alice"); delay != 0 {
+		t.Fatalf("first reserve() = %s, want 0", delay)
+	}
+	for i := 0; i < 3; i++ {
+		// Denied reservations must not push the next token further out.
+		if delay := limits.reserve("alice"); delay <= 0 || delay > time.Second {
+			t.Errorf("reserve() %d = %s, want at most 1s", i, delay)
+		}
+	}
+	if delay := limits.reserve("bob"); delay != 0 {
+		t.Errorf("reserve() of another identity = %s, want 0", delay)
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		delay time.Duration
+		want  string
+	}{
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Millisecond, "1"},
+		{time.Minute, "60"},
+	}
+	for _, tt := range tests {
+		if got := retryAfterSeconds(tt.delay); got != tt.want {
+			t.Errorf("retryAfterSeconds(%s) = %q, want %q", tt.delay, got, tt.want)
+		}
+	}
+}
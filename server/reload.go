@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watchedFiles returns the files a config reload reads.
+func (s *Server) watchedFiles() []string {
+	cfg := s.current().cfg
+	var files []string
+	if cfg.File() != "" {
+		files = append(files, cfg.File())
+	}
+	if cfg.Auth.KeysFile != "" {
+		files = append(files, cfg.Auth.KeysFile)
+	}
+	return files
+}
+
+// fileSums returns the SHA-256 of each file. Comparing contents rather than
+// modification times also catches files replaced through a symlink, as
+// Kubernetes does for mounted ConfigMaps.
+func fileSums(files []string) map[string][sha256.Size]byte {
+	sums := make(map[string][sha256.Size]byte, len(files))
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			// A missing file counts as changed once it is back.
+			continue
+		}
+		sums[f] = sha256.Sum256(data)
+	}
+	return sums
+}
+
+func sameSums(a map[string][sha256.Size]byte, b map[string][sha256.Size]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for f, sum := range a {
+		if b[f] != sum {
+			return false
+		}
+	}
+	return true
+}
+
+// watchConfig reloads the config whenever the config or keys file changes.
+// A rejected config is not retried until the files change again.
+func (s *Server) watchConfig(ctx context.Context) {
+	cfg := s.current().cfg
+	if !cfg.Watch.Enabled || len(s.watchedFiles()) == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(cfg.Watch.Interval))
+	defer ticker.Stop()
+
+	sums := fileSums(s.watchedFiles())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := fileSums(s.watchedFiles())
+		if sameSums(sums, current) {
+			continue
+		}
+		s.logger.Info("config files changed, reloading")
+		_ = s.Reload()
+		// The reload may have changed the keys file to watch.
+		sums = fileSums(s.watchedFiles())
+	}
+}
+
+// reloadOnSignal reloads the config on every SIGHUP until ctx is done.
+func (s *Server) reloadOnSignal(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			s.logger.Info("SIGHUP received, reloading config")
+			_ = s.Reload()
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/acheong08/funcaptcha"
+	tlsclient "github.com/bogdanfinn/tls-client"
+	"github.com/flyingpot/chatgpt-proxy/config"
+	"github.com/flyingpot/chatgpt-proxy/logging"
+	"github.com/flyingpot/chatgpt-proxy/tracing"
+	"github.com/flyingpot/chatgpt-proxy/usage"
+	"github.com/flyingpot/chatgpt-proxy/vault"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Server is a proxy instance. Each Server owns its gin engine, outbound
+// client and cookie jar, so several of them can live in one process.
+//
+// The arkose token client used by funcaptcha is process wide; every started
+// Server keeps it fresh.
+type Server struct {
+	logger *slog.Logger
+	engine *gin.Engine
+	// state holds the config and what is built from it; see Reload.
+	state    atomic.Pointer[state]
+	reloadMu sync.Mutex
+
+	vault         *vault.Vault
+	tokenWarnings tokenWarnings
+	queue         *conversationQueue
+	active        *streamRegistry
+	upstreamStats *upstreamStats
+	usage         *usage.Store
+	metrics       *metrics
+	tracing       tracing.Provider
+	tracer        trace.Tracer
+
+	mu     sync.Mutex
+	srv    *nethttp.Server
+	cancel context.CancelFunc
+}
+
+// streamCancelGrace is how long Shutdown waits for cancelled streams to
+// end.
+const streamCancelGrace = 5 * time.Second
+
+// New builds a Server from cfg. It does not listen or start any goroutine.
+func New(cfg *config.Config) (*Server, error) {
+	logger, err := logging.New(cfg.Log, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		logger:        logger,
+		metrics:       newMetrics(),
+		active:        newStreamRegistry(),
+		upstreamStats: newUpstreamStats(time.Duration(cfg.Health.ErrorWindow)),
+	}
+
+	if cfg.Queue.Enabled {
+		s.queue = newConversationQueue(cfg.Queue.MaxLength, time.Duration(cfg.Queue.WaitTimeout))
+	}
+
+	s.tracing, err = tracing.New(cfg.Tracing)
+	if err != nil {
+		return nil, err
+	}
+	s.tracer = s.tracing.Tracer(tracerName)
+
+	s.usage, err = usage.Open(cfg.Usage.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Vault.Path != "" {
+		key, err := vault.LoadKey(cfg.Vault.Key, cfg.Vault.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.vault, err = vault.Open(cfg.Vault.Path, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	st, err := newState(cfg, nil, s.logger)
+	if err != nil {
+		return nil, err
+	}
+	s.state.Store(st)
+	funcaptcha.SetTLSClient(&st.client)
+
+	gin.SetMode(gin.ReleaseMode)
+	s.engine = gin.New()
+	if err := s.engine.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		return nil, err
+	}
+	s.engine.Use(s.pinState(), s.traceRequests(), s.requestLogging(), s.recoverPanics(), Cors(), s.metrics.observeRequests())
+
+	s.engine.GET("/", func(c *gin.Context) {
+		c.String(200, "Hello, ChatGPT!")
+	})
+
+	s.engine.GET("/ping", func(c *gin.Context) {
+		c.JSON(200, gin.H{"message": "pong"})
+	})
+
+	s.engine.GET("/healthz", s.healthz)
+	s.engine.GET("/readyz", s.readyz)
+
+	if cfg.Metrics.Enabled {
+		s.engine.GET("/metrics", s.metrics.handler())
+	}
+
+	authorized := s.engine.Group("/", s.limitIP(), s.authenticate(), s.limitKey(), s.enforceQuota(), s.checkAccessToken(), s.queueConversations(), s.limitStreams(), s.trackStreams())
+	authorized.Any("/api/*path", s.proxy)
+	authorized.POST("/v1/chat/completions", s.chatCompletions)
+
+	s.registerAdmin()
+	return s, nil
+}
+
+// Handler returns the http.Handler serving the proxy routes.
+func (s *Server) Handler() nethttp.Handler {
+	return s.engine
+}
+
+// Start starts the background work and serves on the configured address. It
+// blocks until the server is shut down; background work stops when ctx is
+// done or Shutdown is called.
+func (s *Server) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	srv := &nethttp.Server{
+		Addr:    s.current().cfg.Server.Addr(),
+		Handler: s.engine,
+	}
+
+	s.mu.Lock()
+	if s.srv != nil {
+		s.mu.Unlock()
+		cancel()
+		return errors.New("server already started")
+	}
+	s.srv = srv
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	go s.recycleArkoseClient(ctx)
+	go s.watchStoredTokens(ctx)
+	go s.flushUsage(ctx)
+	go s.watchConfig(ctx)
+
+	err := srv.ListenAndServe()
+	if errors.Is(err, nethttp.ErrServerClosed) {
+		return nil
+	}
+	cancel()
+	return err
+}
+
+// Shutdown gracefully stops a started server. It stops accepting requests
+// and lets the requests in flight, conversation streams included, finish
+// until ctx is done. Streams still running then have their upstream requests
+// cancelled and the remaining connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv, cancel := s.srv, s.cancel
+	s.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+
+	cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		n := s.active.cancelAll()
+		s.logger.Warn("shutdown deadline reached, cancelling streams", slog.Int("streams", n))
+		err = srv.Close()
+		// Give the cancelled handlers a moment to record their usage.
+		waitCtx, waitCancel := context.WithTimeout(context.Background(), streamCancelGrace)
+		if werr := s.active.wait(waitCtx); werr != nil {
+			s.logger.Warn("streams still running after cancellation", slog.Int("streams", len(s.active.list())))
+		}
+		waitCancel()
+	}
+	s.saveUsage()
+	if err := s.tracing.Shutdown(context.Background()); err != nil {
+		s.logger.Error("failed to flush traces", slog.Any("error", err))
+	}
+	return err
+}
+
+// recycleArkoseClient periodically hands funcaptcha a fresh client with an
+// empty cookie jar.
+func (s *Server) recycleArkoseClient(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.current().cfg.Client.RecycleInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			newclient, err := newClient(s.current().cfg, tlsclient.NewCookieJar(), s.logger)
+			if err != nil {
+				s.logger.Error("failed to create arkose client", slog.Any("error", err))
+				continue
+			}
+			funcaptcha.SetTLSClient(&newclient)
+		}
+	}
+}
+
+// watchStoredTokens periodically warns about stored tokens close to expiry.
+func (s *Server) watchStoredTokens(ctx context.Context) {
+	ticker := time.NewTicker(tokenCheckInterval)
+	defer ticker.Stop()
+	for {
+		s.checkStoredTokens()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func newClient(cfg *config.Config, jar tlsclient.CookieJar, logger *slog.Logger) (tlsclient.HttpClient, error) {
+	c, err := tlsclient.NewHttpClient(tlsclient.NewNoopLogger(), clientOptions(cfg, jar)...)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Client.Proxy != "" {
+		err := c.SetProxy(cfg.Client.Proxy)
+		if err != nil {
+			logger.Error("failed to set proxy", slog.String("proxy", redactProxy(cfg.Client.Proxy)), slog.Any("error", err))
+		} else {
+			logger.Debug("proxy set", slog.String("proxy", redactProxy(cfg.Client.Proxy)))
+		}
+	}
+	return c, nil
+}
+
+// redactProxy returns the proxy URL without its password, which is not
+// logged even when redaction is off.
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "invalid URL"
+	}
+	return u.Redacted()
+}
+
+func clientOptions(cfg *config.Config, jar tlsclient.CookieJar) []tlsclient.HttpClientOption {
+	return []tlsclient.HttpClientOption{
+		tlsclient.WithTimeoutMilliseconds(int(time.Duration(cfg.Client.Timeout).Milliseconds())),
+		tlsclient.WithClientProfile(tlsclient.MappedTLSClients[cfg.Client.Profile]),
+		tlsclient.WithNotFollowRedirects(),
+		tlsclient.WithCookieJar(jar), // create cookieJar instance and pass it as argument
+	}
+}
+
+// Run serves cfg until ctx is done, then shuts the server down, draining
+// active streams for up to the configured shutdown timeout. SIGHUP reloads
+// the config.
+func Run(ctx context.Context, cfg *config.Config) error {
+	s, err := New(cfg)
+	if err != nil {
+		return err
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Start(ctx)
+	}()
+	go s.reloadOnSignal(ctx)
+	s.logger.Info("listening", slog.String("addr", cfg.Server.Addr()))
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	timeout := time.Duration(cfg.Server.ShutdownTimeout)
+	s.logger.Info("shutting down", slog.Int("streams", len(s.active.list())), slog.Duration("timeout", timeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	return <-errc
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+const doneData = "[DONE]"
+
+// ConversationEvent is one decoded frame of an upstream /conversation stream.
+type ConversationEvent struct {
+	// Event is the SSE event name, empty for plain data frames.
+	Event string
+	// Data is the payload of the frame as received.
+	Data []byte
+	// Done reports the terminal [DONE] frame.
+	Done bool
+
+	ConversationID string
+	MessageID      string
+	Role           string
+	ContentType    string
+	// Parts holds the cumulative content of the message so far.
+	Parts   []string
+	Status  string
+	EndTurn bool
+	// Error is the error reported by the upstream inside the stream.
+	Error string
+}
+
+// Text returns the cumulative text of the message.
+func (e *ConversationEvent) Text() string {
+	return strings.Join(e.Parts, "")
+}
+
+// IsMessage reports whether the frame carries a message.
+func (e *ConversationEvent) IsMessage() bool {
+	return e.MessageID != ""
+}
+
+type conversationFrame struct {
+	Message *struct {
+		ID      string  `json:"id"`
+		Author  Author  `json:"author"`
+		Content Content `json:"content"`
+		Status  string  `json:"status"`
+		EndTurn *bool   `json:"end_turn"`
+	} `json:"message"`
+	ConversationID string      `json:"conversation_id"`
+	Error          interface{} `json:"error"`
+}
+
+// EventDecoder reads ConversationEvents from an upstream SSE body.
+type EventDecoder struct {
+	reader *bufio.Reader
+}
+
+func NewEventDecoder(r io.Reader) *EventDecoder {
+	return &EventDecoder{reader: bufio.NewReader(r)}
+}
+
+// Next returns the next event of the stream. It returns io.EOF once the stream
+// ends; a frame left unterminated at the end of the stream is still returned.
+// Frames whose data is not JSON are returned with only Event and Data set.
+func (d *EventDecoder) Next() (*ConversationEvent, error) {
+	var event string
+	var data [][]byte
+	for {
+		line, err := d.reader.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimRight(line, "\r\n")
+			if len(line) == 0 {
+				if len(data) > 0 {
+					return decodeEvent(event, bytes.Join(data, []byte("\n"))), nil
+				}
+				event = ""
+			} else if line[0] != ':' {
+				field, value, _ := bytes.Cut(line, []byte(":"))
+				value = bytes.TrimPrefix(value, []byte(" "))
+				switch string(field) {
+				case "event":
+					event = string(value)
+				case "data":
+					data = append(data, append([]byte(nil), value...))
+				}
+			}
+		}
+
+		if err != nil {
+			if err == io.EOF && len(data) > 0 {
+				return decodeEvent(event, bytes.Join(data, []byte("\n"))), nil
+			}
+			return nil, err
+		}
+	}
+}
+
+func decodeEvent(event string, data []byte) *ConversationEvent {
+	e := &ConversationEvent{Event: event, Data: data}
+	if string(data) == doneData {
+		e.Done = true
+		return e
+	}
+
+	var frame conversationFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return e
+	}
+	e.ConversationID = frame.ConversationID
+	if frame.Message != nil {
+		e.MessageID = frame.Message.ID
+		e.Role = frame.Message.Author.Role
+		e.ContentType = frame.Message.Content.ContentType
+		e.Parts = frame.Message.Content.Parts
+		e.Status = frame.Message.Status
+		e.EndTurn = frame.Message.EndTurn != nil && *frame.Message.EndTurn
+	}
+	switch v := frame.Error.(type) {
+	case nil:
+	case string:
+		e.Error = v
+	default:
+		b, _ := json.Marshal(v)
+		e.Error = string(b)
+	}
+	return e
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeAll returns every event of stream.
+func decodeAll(t *testing.T, stream string) []*ConversationEvent {
+	t.Helper()
+	var events []*ConversationEvent
+	decoder := NewEventDecoder(strings.NewReader(stream))
+	for {
+		event, err := decoder.Next()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		events = append(events, event)
+	}
+}
+
+func messageFrame(id string, role string, text string) string {
+	return `{"message": {"id": "` + id + `", "author": {"role": "` + role + `"}, "content": {"content_type": "text", "parts": ["` + text + `"]}, "status": "in_progress", "end_turn": null}, "conversation_id": "c1", "error": null}`
+}
+
+func TestEventDecoderFrames(t *testing.T) {
+	stream := "data: " + messageFrame("m1", "assistant", "Hel") + "\n\n" +
+		"data: " + messageFrame("m1", "assistant", "Hello") + "\n\n" +
+		"data: [DONE]\n\n"
+
+	events := decodeAll(t, stream)
+	if len(events) != 3 {
+		t.Fatalf("decoded %d events, want 3", len(events))
+	}
+	for i, want := range []string{"Hel", "Hello"} {
+		e := events[i]
+		if e.MessageID != "m1" || e.Role != "assistant" || e.ConversationID != "c1" || e.ContentType != "text" {
+			t.Errorf("event %d = %+v", i, e)
+		}
+		if e.Text() != want || !e.IsMessage() || e.Done {
+			t.Errorf("event %d text = %q, want %q", i, e.Text(), want)
+		}
+	}
+	if !events[2].Done || events[2].IsMessage() || string(events[2].Data) != doneData {
+		t.Errorf("last event = %+v, want [DONE]", events[2])
+	}
+}
+
+func TestEventDecoderLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []ConversationEvent
+	}{
+		{
+			name:   "multi-line data",
+			stream: "data: first\ndata: second\n\n",
+			want:   []ConversationEvent{{Data: []byte("first\nsecond")}},
+		},
+		{
+			name:   "event name",
+			stream: "event: ping\ndata: {}\n\n",
+			want:   []ConversationEvent{{Event: "ping", Data: []byte("{}")}},
+		},
+		{
+			name:   "event name does not leak into the next frame",
+			stream: "event: ping\ndata: a\n\ndata: b\n\n",
+			want:   []ConversationEvent{{Event: "ping", Data: []byte("a")}, {Data: []byte("b")}},
+		},
+		{
+			name:   "CRLF line endings",
+			stream: "data: a\r\n\r\ndata: b\r\n\r\n",
+			want:   []ConversationEvent{{Data: []byte("a")}, {Data: []byte("b")}},
+		},
+		{
+			name:   "comments and unknown fields",
+			stream: ": queue position 1\n\nid: 7\nretry: 100\ndata: a\n\n",
+			want:   []ConversationEvent{{Data: []byte("a")}},
+		},
+		{
+			name:   "no space after the colon",
+			stream: "data:a\n\n",
+			want:   []ConversationEvent{{Data: []byte("a")}},
+		},
+		{
+			name:   "extra blank lines",
+			stream: "\n\ndata: a\n\n\n\ndata: b\n\n",
+			want:   []ConversationEvent{{Data: []byte("a")}, {Data: []byte("b")}},
+		},
+		{
+			name:   "unterminated frame at EOF",
+			stream: "data: a\n\ndata: b",
+			want:   []ConversationEvent{{Data: []byte("a")}, {Data: []byte("b")}},
+		},
+		{
+			name:   "unterminated line at EOF",
+			stream: "data: a\n",
+			want:   []ConversationEvent{{Data: []byte("a")}},
+		},
+		{
+			name:   "done",
+			stream: "data: [DONE]\n\n",
+			want:   []ConversationEvent{{Data: []byte(doneData), Done: true}},
+		},
+		{
+			name:   "empty stream",
+			stream: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := decodeAll(t, tt.stream)
+			var got []ConversationEvent
+			for _, e := range events {
+				got = append(got, *e)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"string", `{"message": null, "error": "Something went wrong"}`, "Something went wrong"},
+		{"object", `{"message": null, "error": {"code": "x"}}`, `{"code":"x"}`},
+		{"null", `{"message": null, "error": null}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := decodeAll(t, "data: "+tt.data+"\n\n")
+			if len(events) != 1 {
+				t.Fatalf("decoded %d events, want 1", len(events))
+			}
+			if events[0].Error != tt.want {
+				t.Errorf("Error = %q, want %q", events[0].Error, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventDecoderEndTurn(t *testing.T) {
+	data := `{"message": {"id": "m1", "author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["a", "b"]}, "status": "finished_successfully", "end_turn": true}}`
+	events := decodeAll(t, "data: "+data+"\n\n")
+	if len(events) != 1 {
+		t.Fatalf("decoded %d events, want 1", len(events))
+	}
+	e := events[0]
+	if !e.EndTurn || e.Status != "finished_successfully" || e.Text() != "ab" {
+		t.Errorf("event = %+v", e)
+	}
+}
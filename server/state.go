@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+
+	"github.com/acheong08/funcaptcha"
+	tlsclient "github.com/bogdanfinn/tls-client"
+	"github.com/flyingpot/chatgpt-proxy/config"
+	"github.com/gin-gonic/gin"
+)
+
+// contextState holds the state a request was started with.
+const contextState = "state"
+
+// state holds what a config reload can change while the server runs. It is
+// never modified once published; a reload or client rotation publishes a new
+// one. Requests keep the state they started with, so a request never mixes
+// two configs and in-flight streams finish on the client they started on.
+type state struct {
+	cfg    *config.Config
+	jar    tlsclient.CookieJar
+	client tlsclient.HttpClient
+
+	keys            apiKeys
+	adminKeys       adminKeys
+	ipLimits        *limiterSet
+	keyLimits       *limiterSet
+	streams         *streamLimiter
+	requestHeaders  []headerPolicy
+	responseHeaders headerMatcher
+}
+
+// newState builds the state of cfg. Parts whose settings did not change
+// since prev are carried over, so that a reload does not reset rate limits
+// or drop the cookies of the outbound client.
+func newState(cfg *config.Config, prev *state, logger *slog.Logger) (*state, error) {
+	st := &state{
+		cfg:             cfg,
+		keys:            newAPIKeys(cfg.Auth.Keys),
+		adminKeys:       newAdminKeys(cfg.Auth.AdminKeys),
+		requestHeaders:  newHeaderPolicies(cfg.Headers.Request),
+		responseHeaders: newHeaderMatcher(cfg.Headers.Response),
+	}
+
+	if prev != nil && prev.cfg.Client == cfg.Client {
+		st.jar, st.client = prev.jar, prev.client
+	} else {
+		st.jar = tlsclient.NewCookieJar()
+		client, err := newClient(cfg, st.jar, logger)
+		if err != nil {
+			return nil, err
+		}
+		st.client = client
+	}
+
+	if prev != nil && prev.cfg.Limits.PerIP == cfg.Limits.PerIP {
+		st.ipLimits = prev.ipLimits
+	} else {
+		st.ipLimits = newLimiterSet(cfg.Limits.PerIP)
+	}
+	if prev != nil && prev.cfg.Limits.PerKey == cfg.Limits.PerKey {
+		st.keyLimits = prev.keyLimits
+	} else {
+		st.keyLimits = newLimiterSet(cfg.Limits.PerKey)
+	}
+	if prev != nil && prev.cfg.Limits.MaxStreams == cfg.Limits.MaxStreams && prev.cfg.Limits.MaxStreamsPerKey == cfg.Limits.MaxStreamsPerKey {
+		st.streams = prev.streams
+	} else {
+		st.streams = newStreamLimiter(cfg.Limits)
+	}
+	return st, nil
+}
+
+// current returns the state new requests start with.
+func (s *Server) current() *state {
+	return s.state.Load()
+}
+
+// requestState returns the state the request started with.
+func (s *Server) requestState(c *gin.Context) *state {
+	if v, ok := c.Get(contextState); ok {
+		return v.(*state)
+	}
+	return s.current()
+}
+
+// pinState attaches the current state to the request.
+func (s *Server) pinState() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(contextState, s.current())
+		c.Next()
+	}
+}
+
+// Reload loads the config again from its sources and applies it. An invalid
+// config is rejected and the running one kept. Settings that are only read
+// at startup, like the listen address, the vault or the logger, keep their
+// old values until the next restart. Keys using vault tokens are rejected
+// while no vault is open.
+func (s *Server) Reload() error {
+	_, err := s.reload()
+	return err
+}
+
+// reload is Reload, also returning the changed sections that need a
+// restart.
+func (s *Server) reload() ([]string, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	prev := s.current()
+	cfg, err := prev.cfg.Reload()
+	if err != nil {
+		s.logger.Error("config reload rejected", slog.Any("error", err))
+		return nil, err
+	}
+	if err := s.checkVault(cfg); err != nil {
+		s.logger.Error("config reload rejected", slog.Any("error", err))
+		return nil, err
+	}
+	st, err := newState(cfg, prev, s.logger)
+	if err != nil {
+		s.logger.Error("config reload rejected", slog.Any("error", err))
+		return nil, err
+	}
+	if st.client != prev.client {
+		funcaptcha.SetTLSClient(&st.client)
+	}
+	s.state.Store(st)
+
+	sections := restartRequired(prev.cfg, cfg)
+	if len(sections) > 0 {
+		s.logger.Warn("config reloaded, some changes need a restart", slog.Any("sections", sections))
+	} else {
+		s.logger.Info("config reloaded")
+	}
+	return sections, nil
+}
+
+// checkVault rejects a config whose keys use vault tokens while no vault is
+// open. The vault is only opened at startup, so enabling it takes a
+// restart.
+func (s *Server) checkVault(cfg *config.Config) error {
+	if s.vault != nil {
+		return nil
+	}
+	for _, k := range cfg.Auth.Keys {
+		if k.Token != "" {
+			return fmt.Errorf("api key %s: token %q needs the vault, which is only opened at startup", k.Name, k.Token)
+		}
+	}
+	return nil
+}
+
+// RotateClient replaces the outbound client and the arkose client with new
+// ones with empty cookie jars.
+func (s *Server) RotateClient() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	prev := s.current()
+	st := *prev
+	st.jar = tlsclient.NewCookieJar()
+	client, err := newClient(st.cfg, st.jar, s.logger)
+	if err != nil {
+		return err
+	}
+	st.client = client
+	s.state.Store(&st)
+
+	arkose, err := newClient(st.cfg, tlsclient.NewCookieJar(), s.logger)
+	if err != nil {
+		return err
+	}
+	funcaptcha.SetTLSClient(&arkose)
+	s.logger.Info("outbound clients rotated")
+	return nil
+}
+
+// restartRequired returns the config sections that differ between old and
+// cfg but are only applied at startup.
+func restartRequired(old *config.Config, cfg *config.Config) []string {
+	var sections []string
+	check := func(name string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			sections = append(sections, name)
+		}
+	}
+	check("server", old.Server, cfg.Server)
+	check("vault", old.Vault, cfg.Vault)
+	check("queue", old.Queue, cfg.Queue)
+	check("usage.path", old.Usage.Path, cfg.Usage.Path)
+	check("usage.flush_interval", old.Usage.FlushInterval, cfg.Usage.FlushInterval)
+	check("metrics", old.Metrics, cfg.Metrics)
+	check("log", old.Log, cfg.Log)
+	check("tracing", old.Tracing, cfg.Tracing)
+	check("health.error_window", old.Health.ErrorWindow, cfg.Health.ErrorWindow)
+	check("client.recycle_interval", old.Client.RecycleInterval, cfg.Client.RecycleInterval)
+	check("watch", old.Watch, cfg.Watch)
+	check("auth.admin_keys", len(old.Auth.AdminKeys) == 0, len(cfg.Auth.AdminKeys) == 0)
+	return sections
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	streamModeHeader = "X-Stream-Mode"
+	streamModeQuery  = "stream_mode"
+
+	// streamModeFull relays the upstream frames unchanged, each carrying the
+	// cumulative text of the message.
+	streamModeFull = "full"
+	// streamModeDelta rewrites each frame to carry only the text appended
+	// since the previous frame of the same message.
+	streamModeDelta = "delta"
+	// streamModeAggregate consumes the whole stream and answers with a single
+	// JSON document.
+	streamModeAggregate = "aggregate"
+)
+
+// AggregatedConversation is the response of the aggregate stream mode.
+type AggregatedConversation struct {
+	// Message is the final message object as sent by the upstream.
+	Message        json.RawMessage `json:"message"`
+	ConversationID string          `json:"conversation_id"`
+	// ParentMessageID is the id of the final message, to be sent as
+	// parent_message_id when continuing the conversation.
+	ParentMessageID string `json:"parent_message_id"`
+}
+
+// streamMode returns the stream mode requested by the caller through the
+// X-Stream-Mode header or the stream_mode query parameter.
+func streamMode(c *gin.Context) string {
+	mode := c.GetHeader(streamModeHeader)
+	if mode == "" {
+		mode = c.Query(streamModeQuery)
+	}
+	mode = strings.ToLower(mode)
+	switch mode {
+	case streamModeDelta, streamModeAggregate:
+		return mode
+	default:
+		return streamModeFull
+	}
+}
+
+// upstreamQuery strips the proxy's own parameters from the caller's query.
+func upstreamQuery(rawQuery string) string {
+	if !strings.Contains(rawQuery, streamModeQuery) && !strings.Contains(rawQuery, queueEventsQuery) {
+		return rawQuery
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	values.Del(streamModeQuery)
+	values.Del(queueEventsQuery)
+	return values.Encode()
+}
+
+// streamFull relays an upstream /conversation stream frame by frame, passing
+// every frame to observe.
+func streamFull(c *gin.Context, body io.Reader, observe func(*ConversationEvent)) {
+	if c.Writer.Header().Get("Content-Type") == "" {
+		c.Writer.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	}
+
+	decoder := NewEventDecoder(body)
+	for {
+		event, err := decoder.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			logStreamError(c, err)
+			return
+		}
+		observe(event)
+
+		if err := writeEvent(c.Writer, event.Event, event.Data); err != nil {
+			requestLogger(c).Warn("error writing to client", slog.Any("error", err))
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+// streamDelta relays an upstream /conversation stream, replacing the
+// cumulative parts of every message frame with the newly appended text.
+// Message ids, non-message frames and the terminal [DONE] are kept. Every
+// frame is passed to observe as received.
+func streamDelta(c *gin.Context, body io.Reader, observe func(*ConversationEvent)) {
+	c.Writer.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+
+	sent := make(map[string]string)
+	decoder := NewEventDecoder(body)
+	for {
+		event, err := decoder.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			logStreamError(c, err)
+			return
+		}
+		observe(event)
+
+		data := event.Data
+		if event.IsMessage() {
+			text := event.Text()
+			delta := text
+			if prev, ok := sent[event.MessageID]; ok && strings.HasPrefix(text, prev) {
+				delta = text[len(prev):]
+			}
+			sent[event.MessageID] = text
+
+			data, err = replaceParts(event.Data, []string{delta})
+			if err != nil {
+				data = event.Data
+			}
+		}
+
+		if err := writeEvent(c.Writer, event.Event, data); err != nil {
+			requestLogger(c).Warn("error writing to client", slog.Any("error", err))
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+// aggregateConversation consumes an upstream /conversation stream and
+// answers with the final message. A stream that reports an error or ends
+// before [DONE] is answered with an upstream_stream_error. Every frame is
+// passed to observe.
+func aggregateConversation(c *gin.Context, body io.Reader, observe func(*ConversationEvent)) {
+	var result AggregatedConversation
+	var final *ConversationEvent
+	decoder := NewEventDecoder(body)
+	for {
+		event, err := decoder.Next()
+		if err == io.EOF {
+			abortWithError(c, apierror.Stream("upstream stream ended unexpectedly"))
+			return
+		}
+		if err != nil {
+			abortWithError(c, apierror.Stream(err.Error()))
+			return
+		}
+		observe(event)
+		if event.Error != "" {
+			abortWithError(c, apierror.Stream(event.Error))
+			return
+		}
+		if event.Done {
+			break
+		}
+
+		if event.ConversationID != "" {
+			result.ConversationID = event.ConversationID
+		}
+		if event.IsMessage() && (final == nil || event.Role == "assistant" || final.Role != "assistant") {
+			final = event
+		}
+	}
+
+	if final == nil {
+		abortWithError(c, apierror.Stream("upstream stream contained no message"))
+		return
+	}
+	var frame struct {
+		Message json.RawMessage `json:"message"`
+	}
+	if err := json.Unmarshal(final.Data, &frame); err != nil {
+		abortWithError(c, apierror.Stream(err.Error()))
+		return
+	}
+	result.Message = frame.Message
+	result.ParentMessageID = final.MessageID
+	c.JSON(200, result)
+}
+
+// replaceParts sets message.content.parts of a raw frame, leaving every other
+// field untouched.
+func replaceParts(data []byte, parts []string) ([]byte, error) {
+	var frame, message, content map[string]json.RawMessage
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(frame["message"], &message); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(message["content"], &content); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if content["parts"], err = json.Marshal(parts); err != nil {
+		return nil, err
+	}
+	if message["content"], err = json.Marshal(content); err != nil {
+		return nil, err
+	}
+	if frame["message"], err = json.Marshal(message); err != nil {
+		return nil, err
+	}
+	return json.Marshal(frame)
+}
+
+func writeEvent(w io.Writer, event string, data []byte) error {
+	if event != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if _, err := fmt.Fprintf(w, "data: %s\n", line); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// contextStream holds the *activeStream of a conversation request.
+const contextStream = "stream"
+
+// activeStream is a conversation stream in flight.
+type activeStream struct {
+	ID        string    `json:"id"`
+	RequestID string    `json:"request_id"`
+	Caller    string    `json:"caller"`
+	Route     string    `json:"route"`
+	Start     time.Time `json:"started_at"`
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// streamRegistry tracks the conversation streams in flight, so that they can
+// be drained and cancelled on shutdown.
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[string]*activeStream
+	// empty is closed and replaced whenever the last stream ends.
+	empty chan struct{}
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{streams: make(map[string]*activeStream), empty: make(chan struct{})}
+}
+
+// add registers a stream under a new id. Its context, derived from parent,
+// is also cancelled by cancel, cancelAll or once the stream is removed.
+func (r *streamRegistry) add(parent context.Context, requestID string, caller string, route string) *activeStream {
+	ctx, cancel := context.WithCancel(parent)
+	stream := &activeStream{
+		ID:        randomHex(8),
+		RequestID: requestID,
+		Caller:    caller,
+		Route:     route,
+		Start:     time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	r.mu.Lock()
+	r.streams[stream.ID] = stream
+	r.mu.Unlock()
+	return stream
+}
+
+func (r *streamRegistry) remove(stream *activeStream) {
+	stream.cancel()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.streams, stream.ID)
+	if len(r.streams) == 0 {
+		close(r.empty)
+		r.empty = make(chan struct{})
+	}
+}
+
+// list returns the streams in flight, oldest first.
+func (r *streamRegistry) list() []*activeStream {
+	r.mu.Lock()
+	streams := make([]*activeStream, 0, len(r.streams))
+	for _, stream := range r.streams {
+		streams = append(streams, stream)
+	}
+	r.mu.Unlock()
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Start.Before(streams[j].Start) })
+	return streams
+}
+
+// cancel cancels the upstream request of the stream id and reports whether
+// it was in flight.
+func (r *streamRegistry) cancel(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stream, ok := r.streams[id]
+	if ok {
+		stream.cancel()
+	}
+	return ok
+}
+
+// cancelAll cancels the upstream requests of every stream in flight and
+// returns how many there were.
+func (r *streamRegistry) cancelAll() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, stream := range r.streams {
+		stream.cancel()
+	}
+	return len(r.streams)
+}
+
+// wait blocks until no stream is in flight or ctx is done.
+func (r *streamRegistry) wait(ctx context.Context) error {
+	for {
+		r.mu.Lock()
+		n, empty := len(r.streams), r.empty
+		r.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-empty:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// trackStreams registers conversation streams for the time they are
+// handled and counts the generations aborted before they were done.
+func (s *Server) trackStreams() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isConversation(c) {
+			c.Next()
+			return
+		}
+		stream := s.active.add(c.Request.Context(), c.GetString(contextRequestID), usageUser(c), c.Request.URL.Path)
+		c.Set(contextStream, stream)
+		defer s.active.remove(stream)
+		c.Next()
+
+		switch {
+		case c.Request.Context().Err() != nil:
+			s.metrics.abortedGenerations.WithLabelValues("client_disconnect").Inc()
+		case stream.ctx.Err() != nil:
+			s.metrics.abortedGenerations.WithLabelValues("cancelled").Inc()
+		}
+	}
+}
+
+// upstreamContext returns the context upstream requests of c are bound to:
+// the inbound request context, so that a caller disconnecting aborts the
+// upstream request, or for streams the stream context, which the proxy can
+// also cancel.
+func upstreamContext(c *gin.Context) context.Context {
+	if v, ok := c.Get(contextStream); ok {
+		return v.(*activeStream).ctx
+	}
+	return c.Request.Context()
+}
+
+// logStreamError logs a failed read of an upstream stream. A stream whose
+// upstream request was cancelled, by the proxy or by the caller
+// disconnecting, is logged as such rather than as an error.
+func logStreamError(c *gin.Context, err error) {
+	if upstreamContext(c).Err() != nil {
+		requestLogger(c).Info("upstream stream cancelled", slog.Any("error", err))
+		return
+	}
+	requestLogger(c).Error("error reading upstream stream", slog.Any("error", err))
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/flyingpot/chatgpt-proxy/server"
+
+// traceRequests starts the server span of every request, continuing the
+// caller's trace when it sends a traceparent header.
+func (s *Server) traceRequests() gin.HandlerFunc {
+	return otelgin.Middleware(s.current().cfg.Tracing.ServiceName,
+		otelgin.WithTracerProvider(s.tracing),
+		otelgin.WithPropagators(propagation.TraceContext{}),
+	)
+}
+
+// startSpan starts a span as a child of the span in ctx.
+func (s *Server) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceAttrs returns the log attributes linking a log line to the span in
+// ctx.
+func traceAttrs(ctx context.Context) []any {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return []any{slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String())}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/flyingpot/chatgpt-proxy/apierror"
+	"github.com/flyingpot/chatgpt-proxy/config"
+	"github.com/flyingpot/chatgpt-proxy/usage"
+	"github.com/gin-gonic/gin"
+)
+
+// usageUser returns the name usage of the request is accounted under: the
+// name of the proxy key, or config.AnonymousUser without keys.
+func usageUser(c *gin.Context) string {
+	if name := c.GetString(contextKeyName); name != "" {
+		return name
+	}
+	return config.AnonymousUser
+}
+
+// quota returns the quota of a proxy key.
+func quota(cfg *config.Config, user string) usage.Quota {
+	if q, ok := cfg.Usage.Quotas.Keys[user]; ok {
+		return usage.Quota(q)
+	}
+	return usage.Quota(cfg.Usage.Quotas.Default)
+}
+
+// enforceQuota rejects conversations of callers whose quota is exhausted.
+func (s *Server) enforceQuota() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isConversation(c) {
+			c.Next()
+			return
+		}
+		var quotaErr *usage.QuotaError
+		if err := s.usage.Check(usageUser(c), quota(s.requestState(c).cfg, usageUser(c))); errors.As(err, &quotaErr) {
+			abortWithError(c, apierror.QuotaExceeded(quotaErr.Error(), time.Until(quotaErr.Reset)))
+			return
+		}
+		c.Next()
+	}
+}
+
+// recordUsage accounts a conversation of the caller. model is the upstream
+// model name, so that both conversation routes count a model under the same
+// name.
+func (s *Server) recordUsage(c *gin.Context, model string, prompt string, completion string) {
+	s.usage.Record(usageUser(c), model, prompt, completion)
+}
+
+// conversationPrompt returns the text sent in a conversation request.
+func conversationPrompt(cRequest *CreateConversationRequest) string {
+	var b strings.Builder
+	for _, m := range cRequest.Messages {
+		for _, p := range m.Content.Parts {
+			b.WriteString(p)
+		}
+	}
+	return b.String()
+}
+
+// completion collects the assistant text of an upstream /conversation
+// stream.
+type completion struct {
+	text string
+}
+
+func (t *completion) observe(event *ConversationEvent) {
+	if event.Role == "assistant" {
+		t.text = event.Text()
+	}
+}
+
+// flushUsage periodically persists the usage store.
+func (s *Server) flushUsage(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.current().cfg.Usage.FlushInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.saveUsage()
+		}
+	}
+}
+
+func (s *Server) saveUsage() {
+	if err := s.usage.Flush(); err != nil {
+		s.logger.Error("failed to save usage", slog.Any("error", err))
+	}
+}
+
+func (s *Server) getUsage(c *gin.Context) {
+	users := s.usage.Snapshot()
+	if name := c.Query("user"); name != "" {
+		u, ok := users[name]
+		if !ok {
+			abortWithError(c, apierror.New(apierror.CodeNotFound, 404, "no usage recorded for this user"))
+			return
+		}
+		c.JSON(200, gin.H{"users": gin.H{name: u}})
+		return
+	}
+	c.JSON(200, gin.H{"users": users})
+}
@@ -0,0 +1,65 @@
+// Package tracing sets up the OpenTelemetry tracer provider of the proxy.
+package tracing
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/flyingpot/chatgpt-proxy/config"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Provider is a tracer provider that can be shut down, flushing the spans
+// not exported yet.
+type Provider interface {
+	trace.TracerProvider
+	Shutdown(ctx context.Context) error
+}
+
+type noopProvider struct {
+	noop.TracerProvider
+}
+
+func (noopProvider) Shutdown(context.Context) error {
+	return nil
+}
+
+// New returns a provider exporting spans to the configured endpoint, or a
+// provider that records nothing if tracing is disabled.
+func New(cfg config.Tracing) (Provider, error) {
+	if cfg.Endpoint == "" {
+		return noopProvider{noop.NewTracerProvider()}, nil
+	}
+
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(u.Path))
+	}
+	if len(cfg.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+	// The exporter connects lazily, so an unreachable collector does not
+	// keep the proxy from starting.
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(cfg.ServiceName))),
+	), nil
+}
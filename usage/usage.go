@@ -0,0 +1,263 @@
+// Package usage accounts the conversations of each proxy user and enforces
+// their quotas.
+//
+// Counters are kept per user and model for all time, and per user for each
+// UTC day and month. They are persisted as JSON when a path is configured.
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+	// keepDays and keepMonths bound the stored period counters.
+	keepDays   = 62
+	keepMonths = 24
+)
+
+// Counters are the usage figures of a user, model or period.
+type Counters struct {
+	Requests int64 `json:"requests"`
+	// Characters counts the characters streamed back to the user.
+	Characters int64 `json:"characters"`
+	// Tokens is the estimated number of prompt and completion tokens.
+	Tokens int64 `json:"tokens"`
+}
+
+func (c *Counters) add(o Counters) {
+	c.Requests += o.Requests
+	c.Characters += o.Characters
+	c.Tokens += o.Tokens
+}
+
+// User is the usage of one user.
+type User struct {
+	Models map[string]Counters `json:"models"`
+	Days   map[string]Counters `json:"days"`
+	Months map[string]Counters `json:"months"`
+}
+
+// Quota limits a user's usage. Zero values are unlimited.
+type Quota struct {
+	DailyRequests   int64
+	DailyTokens     int64
+	MonthlyRequests int64
+	MonthlyTokens   int64
+}
+
+// QuotaError reports an exhausted quota.
+type QuotaError struct {
+	Limit string
+	// Reset is when the exhausted period ends.
+	Reset time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota exceeded, resets at %s", e.Limit, e.Reset.Format(time.RFC3339))
+}
+
+// Store holds the usage of every user. It is safe for concurrent use.
+type Store struct {
+	path string
+	// now returns the current time; tests replace it.
+	now func() time.Time
+
+	mu    sync.Mutex
+	users map[string]*User
+	dirty bool
+}
+
+// Open loads the store persisted at path. An empty path keeps usage in
+// memory only.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, now: time.Now, users: make(map[string]*User)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.users); err != nil {
+		return nil, fmt.Errorf("parse usage %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// EstimateTokens approximates the token count of text: four ASCII
+// characters or one other character per token.
+func EstimateTokens(text string) int64 {
+	var ascii, other int64
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// Record adds one request of user on model, with the prompt sent and the
+// completion streamed back.
+func (s *Store) Record(user string, model string, prompt string, completion string) {
+	now := s.now().UTC()
+	c := Counters{
+		Requests:   1,
+		Characters: int64(utf8.RuneCountInString(completion)),
+		Tokens:     EstimateTokens(prompt) + EstimateTokens(completion),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(user)
+	add(u.Models, model, c)
+	add(u.Days, now.Format(dayLayout), c)
+	add(u.Months, now.Format(monthLayout), c)
+	prune(u.Days, keepDays)
+	prune(u.Months, keepMonths)
+	s.dirty = true
+}
+
+// Check returns a *QuotaError if user has exhausted quota.
+func (s *Store) Check(user string, quota Quota) error {
+	now := s.now().UTC()
+	s.mu.Lock()
+	day := s.user(user).Days[now.Format(dayLayout)]
+	month := s.user(user).Months[now.Format(monthLayout)]
+	s.mu.Unlock()
+
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	switch {
+	case quota.DailyRequests > 0 && day.Requests >= quota.DailyRequests:
+		return &QuotaError{Limit: "daily request", Reset: tomorrow}
+	case quota.DailyTokens > 0 && day.Tokens >= quota.DailyTokens:
+		return &QuotaError{Limit: "daily token", Reset: tomorrow}
+	case quota.MonthlyRequests > 0 && month.Requests >= quota.MonthlyRequests:
+		return &QuotaError{Limit: "monthly request", Reset: nextMonth}
+	case quota.MonthlyTokens > 0 && month.Tokens >= quota.MonthlyTokens:
+		return &QuotaError{Limit: "monthly token", Reset: nextMonth}
+	}
+	return nil
+}
+
+// Snapshot returns a copy of the usage of every user.
+func (s *Store) Snapshot() map[string]User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := make(map[string]User, len(s.users))
+	for name, u := range s.users {
+		snapshot[name] = User{
+			Models: copyCounters(u.Models),
+			Days:   copyCounters(u.Days),
+			Months: copyCounters(u.Months),
+		}
+	}
+	return snapshot
+}
+
+// Flush writes the store to its path if it changed since the last flush.
+func (s *Store) Flush() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.users)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		s.markDirty()
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		s.markDirty()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		s.markDirty()
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		s.markDirty()
+		return err
+	}
+	return nil
+}
+
+func (s *Store) markDirty() {
+	s.mu.Lock()
+	s.dirty = true
+	s.mu.Unlock()
+}
+
+func (s *Store) user(name string) *User {
+	u, ok := s.users[name]
+	if !ok {
+		u = &User{}
+		s.users[name] = u
+	}
+	if u.Models == nil {
+		u.Models = make(map[string]Counters)
+	}
+	if u.Days == nil {
+		u.Days = make(map[string]Counters)
+	}
+	if u.Months == nil {
+		u.Months = make(map[string]Counters)
+	}
+	return u
+}
+
+func add(m map[string]Counters, key string, c Counters) {
+	v := m[key]
+	v.add(c)
+	m[key] = v
+}
+
+// prune keeps the keep latest periods. Period keys sort chronologically.
+func prune(m map[string]Counters, keep int) {
+	if len(m) <= keep {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys[:len(keys)-keep] {
+		delete(m, k)
+	}
+}
+
+func copyCounters(m map[string]Counters) map[string]Counters {
+	c := make(map[string]Counters, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
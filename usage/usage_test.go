@@ -0,0 +1,209 @@
+package usage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newStore returns an in-memory store whose clock reads *now.
+func newStore(t *testing.T, now *time.Time) *Store {
+	t.Helper()
+	s, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want int64
+	}{
+		{"", 0},
+		{"abc", 1},
+		{"abcd", 1},
+		{"abcde", 2},
+		{"你好", 2},
+		{"hi 你好", 3},
+	}
+	for _, tt := range tests {
+		if got := EstimateTokens(tt.text); got != tt.want {
+			t.Errorf("EstimateTokens(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	now := time.Date(2023, 7, 14, 12, 0, 0, 0, time.UTC)
+	s := newStore(t, &now)
+	s.Record("alice", "gpt-4", "abcd", "héllo")
+	s.Record("alice", "gpt-3.5", "", "abcd")
+
+	u := s.Snapshot()["alice"]
+	if got, want := u.Models["gpt-4"], (Counters{Requests: 1, Characters: 5, Tokens: 3}); got != want {
+		t.Errorf("gpt-4 counters = %+v, want %+v", got, want)
+	}
+	if got, want := u.Days["2023-07-14"], (Counters{Requests: 2, Characters: 9, Tokens: 4}); got != want {
+		t.Errorf("day counters = %+v, want %+v", got, want)
+	}
+	if got, want := u.Months["2023-07"], (Counters{Requests: 2, Characters: 9, Tokens: 4}); got != want {
+		t.Errorf("month counters = %+v, want %+v", got, want)
+	}
+}
+
+func TestCheckResets(t *testing.T) {
+	tests := []struct {
+		name      string
+		quota     Quota
+		used      time.Time
+		checked   time.Time
+		wantLimit string
+		wantReset time.Time
+	}{
+		{
+			name:      "daily requests until midnight",
+			quota:     Quota{DailyRequests: 1},
+			used:      time.Date(2023, 7, 14, 0, 0, 0, 0, time.UTC),
+			checked:   time.Date(2023, 7, 14, 23, 59, 59, 0, time.UTC),
+			wantLimit: "daily request",
+			wantReset: time.Date(2023, 7, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "daily requests reset at midnight",
+			quota:   Quota{DailyRequests: 1},
+			used:    time.Date(2023, 7, 14, 23, 59, 59, 0, time.UTC),
+			checked: time.Date(2023, 7, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "daily tokens",
+			quota:     Quota{DailyTokens: 2},
+			used:      time.Date(2023, 7, 14, 8, 0, 0, 0, time.UTC),
+			checked:   time.Date(2023, 7, 14, 9, 0, 0, 0, time.UTC),
+			wantLimit: "daily token",
+			wantReset: time.Date(2023, 7, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "days are UTC",
+			quota:   Quota{DailyRequests: 1},
+			used:    time.Date(2023, 7, 14, 23, 0, 0, 0, time.UTC),
+			checked: time.Date(2023, 7, 15, 1, 0, 0, 0, time.FixedZone("CEST", 2*60*60)),
+			// 23:00 UTC the same day.
+			wantLimit: "daily request",
+			wantReset: time.Date(2023, 7, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "monthly requests until the first",
+			quota:     Quota{MonthlyRequests: 1},
+			used:      time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC),
+			checked:   time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC),
+			wantLimit: "monthly request",
+			wantReset: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "monthly requests reset on the first",
+			quota:   Quota{MonthlyRequests: 1},
+			used:    time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC),
+			checked: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "monthly tokens in february",
+			quota:     Quota{MonthlyTokens: 2},
+			used:      time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+			checked:   time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC),
+			wantLimit: "monthly token",
+			wantReset: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "under quota",
+			quota:   Quota{DailyRequests: 2, DailyTokens: 10, MonthlyRequests: 2, MonthlyTokens: 10},
+			used:    time.Date(2023, 7, 14, 0, 0, 0, 0, time.UTC),
+			checked: time.Date(2023, 7, 14, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "unlimited",
+			used:    time.Date(2023, 7, 14, 0, 0, 0, 0, time.UTC),
+			checked: time.Date(2023, 7, 14, 1, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := tt.used
+			s := newStore(t, &now)
+			// One request of two estimated tokens.
+			s.Record("alice", "gpt-4", "abcd", "abcd")
+
+			now = tt.checked
+			err := s.Check("alice", tt.quota)
+			if tt.wantLimit == "" {
+				if err != nil {
+					t.Fatalf("Check() = %v, want nil", err)
+				}
+				return
+			}
+			var quotaErr *QuotaError
+			if !errors.As(err, &quotaErr) {
+				t.Fatalf("Check() = %v, want a *QuotaError", err)
+			}
+			if quotaErr.Limit != tt.wantLimit || !quotaErr.Reset.Equal(tt.wantReset) {
+				t.Errorf("Check() = %q resetting at %s, want %q resetting at %s",
+					quotaErr.Limit, quotaErr.Reset, tt.wantLimit, tt.wantReset)
+			}
+		})
+	}
+}
+
+func TestCheckOtherUser(t *testing.T) {
+	now := time.Date(2023, 7, 14, 12, 0, 0, 0, time.UTC)
+	s := newStore(t, &now)
+	s.Record("alice", "gpt-4", "", "")
+	if err := s.Check("bob", Quota{DailyRequests: 1}); err != nil {
+		t.Errorf("Check(bob) = %v, want nil", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newStore(t, &now)
+	for i := 0; i < keepDays+10; i++ {
+		s.Record("alice", "gpt-4", "", "")
+		now = now.AddDate(0, 0, 1)
+	}
+
+	u := s.Snapshot()["alice"]
+	if len(u.Days) != keepDays {
+		t.Errorf("kept %d days, want %d", len(u.Days), keepDays)
+	}
+	if _, ok := u.Days["2023-01-10"]; ok {
+		t.Error("oldest days were not pruned")
+	}
+	if got := u.Models["gpt-4"].Requests; got != keepDays+10 {
+		t.Errorf("model requests = %d, want %d", got, keepDays+10)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Record("alice", "gpt-4", "abcd", "abcd")
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(path + ".*.tmp"); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Snapshot()["alice"].Models["gpt-4"]; got != (Counters{Requests: 1, Characters: 4, Tokens: 2}) {
+		t.Errorf("reopened counters = %+v", got)
+	}
+}
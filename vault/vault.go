@@ -0,0 +1,233 @@
+// Package vault stores upstream access tokens encrypted at rest.
+//
+// The whole token set is kept in a single file, sealed with AES-256-GCM:
+//
+//	{"version": 1, "nonce": "<base64>", "data": "<base64>"}
+//
+// The file is rewritten atomically on every change.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fileVersion = 1
+
+// additionalData binds the ciphertext to the file format.
+var additionalData = []byte("chatgpt-proxy vault v1")
+
+// KeySize is the size of the encryption key in bytes.
+const KeySize = 32
+
+// Entry describes a stored token without revealing it.
+type Entry struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type record struct {
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type sealedFile struct {
+	Version int    `json:"version"`
+	Nonce   string `json:"nonce"`
+	Data    string `json:"data"`
+}
+
+type Vault struct {
+	path string
+	aead cipher.AEAD
+
+	mu      sync.RWMutex
+	records map[string]record
+}
+
+// LoadKey returns the encryption key given inline or in keyFile, encoded as
+// base64 (e.g. `openssl rand -base64 32`).
+func LoadKey(key string, keyFile string) ([]byte, error) {
+	if key == "" && keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = string(data)
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, errors.New("vault key is not set")
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("vault key is not valid base64: %w", err)
+	}
+	if len(raw) != KeySize {
+		return nil, fmt.Errorf("vault key must be %d bytes, got %d", KeySize, len(raw))
+	}
+	return raw, nil
+}
+
+// Open opens the vault stored at path, creating an empty one if the file
+// does not exist yet.
+func Open(path string, key []byte) (*Vault, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Vault{
+		path:    path,
+		aead:    aead,
+		records: make(map[string]record),
+	}
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Get returns the token stored under name.
+func (v *Vault) Get(name string) (string, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	r, ok := v.records[name]
+	return r.Token, ok
+}
+
+// List returns the stored entries sorted by name.
+func (v *Vault) List() []Entry {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	entries := make([]Entry, 0, len(v.records))
+	for name, r := range v.records {
+		entries = append(entries, Entry{Name: name, CreatedAt: r.CreatedAt})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// Put stores token under name, replacing any previous token.
+func (v *Vault) Put(name string, token string) error {
+	if name == "" || token == "" {
+		return errors.New("name and token must not be empty")
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	previous, existed := v.records[name]
+	v.records[name] = record{Token: token, CreatedAt: time.Now().UTC()}
+	if err := v.save(); err != nil {
+		if existed {
+			v.records[name] = previous
+		} else {
+			delete(v.records, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the token stored under name and reports whether it existed.
+func (v *Vault) Delete(name string) (bool, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	previous, ok := v.records[name]
+	if !ok {
+		return false, nil
+	}
+	delete(v.records, name)
+	if err := v.save(); err != nil {
+		v.records[name] = previous
+		return false, err
+	}
+	return true, nil
+}
+
+func (v *Vault) load() error {
+	data, err := os.ReadFile(v.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var sealed sealedFile
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return fmt.Errorf("parse vault %s: %w", v.path, err)
+	}
+	if sealed.Version != fileVersion {
+		return fmt.Errorf("unsupported vault version: %d", sealed.Version)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(sealed.Nonce)
+	if err != nil {
+		return fmt.Errorf("parse vault %s: %w", v.path, err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed.Data)
+	if err != nil {
+		return fmt.Errorf("parse vault %s: %w", v.path, err)
+	}
+	if len(nonce) != v.aead.NonceSize() {
+		return fmt.Errorf("parse vault %s: invalid nonce", v.path)
+	}
+	plaintext, err := v.aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return errors.New("failed to decrypt vault, wrong key?")
+	}
+	return json.Unmarshal(plaintext, &v.records)
+}
+
+func (v *Vault) save() error {
+	plaintext, err := json.Marshal(v.records)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data, err := json.Marshal(sealedFile{
+		Version: fileVersion,
+		Nonce:   base64.StdEncoding.EncodeToString(nonce),
+		Data:    base64.StdEncoding.EncodeToString(v.aead.Seal(nil, nonce, plaintext, additionalData)),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(v.path), filepath.Base(v.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), v.path)
+}
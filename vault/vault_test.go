@@ -0,0 +1,221 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	key := newKey(t)
+	v, err := Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Put("main", "token-main"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Put("spare", "token-spare"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Put("main", "token-main-2"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := v.Delete("spare"); !ok || err != nil {
+		t.Fatalf("Delete(spare) = %v, %v", ok, err)
+	}
+	if ok, err := v.Delete("missing"); ok || err != nil {
+		t.Fatalf("Delete(missing) = %v, %v", ok, err)
+	}
+
+	reopened, err := Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, ok := reopened.Get("main"); !ok || token != "token-main-2" {
+		t.Errorf("Get(main) = %q, %v", token, ok)
+	}
+	if _, ok := reopened.Get("spare"); ok {
+		t.Error("deleted token is still stored")
+	}
+	entries := reopened.List()
+	if len(entries) != 1 || entries[0].Name != "main" || entries[0].CreatedAt.IsZero() {
+		t.Errorf("List() = %+v", entries)
+	}
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	v, err := Open(filepath.Join(t.TempDir(), "vault.json"), newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := v.List(); len(entries) != 0 {
+		t.Errorf("List() = %+v, want empty", entries)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	v, err := Open(path, newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Put("main", "token-main"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(path, newKey(t)); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Errorf("Open() with another key = %v, want a decryption error", err)
+	}
+}
+
+func TestTamperedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	key := newKey(t)
+	v, err := Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Put("main", "token-main"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a character of the base64 ciphertext.
+	i := bytes.Index(data, []byte(`"data":"`)) + len(`"data":"`)
+	if data[i] == 'A' {
+		data[i] = 'B'
+	} else {
+		data[i] = 'A'
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, key); err == nil {
+		t.Error("Open() of a tampered file succeeded")
+	}
+}
+
+func TestAtomicRewrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vault.json")
+	v, err := Open(path, newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"secret-1", "secret-2"} {
+		if err := v.Put("main", token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "vault.json" {
+		t.Errorf("files in the vault directory = %v, want only vault.json", files)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("vault file mode = %v, want 0600", perm)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("vault file contains a token in plain text")
+	}
+}
+
+func TestFailedSaveKeepsRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	v, err := Open(path, newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Put("main", "token-main"); err != nil {
+		t.Fatal(err)
+	}
+	// A directory in place of the file makes the rename fail.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Put("main", "token-other"); err == nil {
+		t.Fatal("Put() succeeded although the file cannot be replaced")
+	}
+	if err := v.Put("new", "token-new"); err == nil {
+		t.Fatal("Put() succeeded although the file cannot be replaced")
+	}
+	if token, _ := v.Get("main"); token != "token-main" {
+		t.Errorf("Get(main) = %q after a failed Put, want the previous token", token)
+	}
+	if _, ok := v.Get("new"); ok {
+		t.Error("token of a failed Put is stored")
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(newKey(t))
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		keyFile string
+		wantErr bool
+	}{
+		{name: "inline", key: key},
+		{name: "file", keyFile: keyFile},
+		{name: "inline wins", key: key, keyFile: filepath.Join(t.TempDir(), "missing")},
+		{name: "unset", wantErr: true},
+		{name: "not base64", key: "not base64!", wantErr: true},
+		{name: "too short", key: base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+		{name: "missing file", keyFile: filepath.Join(t.TempDir(), "missing"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := LoadKey(tt.key, tt.keyFile)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("LoadKey() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(raw) != KeySize {
+				t.Errorf("key size = %d, want %d", len(raw), KeySize)
+			}
+		})
+	}
+}